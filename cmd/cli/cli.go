@@ -1,31 +1,46 @@
 package main
 
 import (
-	"context"
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"crypto/ed25519"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 
-	"github.com/google/uuid"
 	"github.com/jroimartin/gocui"
+	"github.com/ngharrington/shitchat/internal"
 	pb "github.com/ngharrington/shitchat/message"
+	"golang.org/x/crypto/ssh"
 )
 
-func createClient(host string, port uint64) (pb.MessageServiceClient, error) {
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", host, port), grpc.WithInsecure())
+// keepaliveInterval is how often the CLI pings a quiet server, so a
+// connection that died without closing, like after losing Wi-Fi, is noticed
+// and reconnected. The server allows pings this often.
+const keepaliveInterval = 30 * time.Second
+
+func createClient(address string, creds credentials.TransportCredentials) (pb.MessageServiceClient, error) {
+	conn, err := grpc.Dial(address,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: keepaliveInterval, Timeout: 10 * time.Second}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -33,31 +48,227 @@ func createClient(host string, port uint64) (pb.MessageServiceClient, error) {
 	return client, nil
 }
 
-var privateKeyPath string
+var (
+	configPath  string
+	profileName string
+
+	serverAddress  string
+	username       string
+	privateKeyPath string
+
+	useTLS  bool
+	tlsCA   string
+	tlsCert string
+	tlsKey  string
+
+	knownHostsPath string
+)
 
 func init() {
-	// Register the --keyfile flag
+	flag.StringVar(&configPath, "config", defaultConfigFile(), "Config file with the profiles to connect with")
+	flag.StringVar(&profileName, "profile", "", "Profile to connect with, the config file's default_profile if empty")
+
+	// These override the profile's settings
+	flag.StringVar(&serverAddress, "server", "localhost:50051", "Address of the server, as host:port")
+	flag.StringVar(&username, "username", "", "Username to log in as, the key file's name if empty")
 	flag.StringVar(&privateKeyPath, "keyfile", "", "Path to the private key file")
+
+	flag.BoolVar(&useTLS, "tls", false, "Connect over TLS, implied by the other --tls flags")
+	flag.StringVar(&tlsCA, "tls-ca", "", "Path to a CA bundle to verify the server with instead of the system roots")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Path to a client certificate for servers that require one")
+	flag.StringVar(&tlsKey, "tls-key", "", "Path to the client certificate's private key")
+
+	knownHosts := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		knownHosts = filepath.Join(home, ".shitchat", "known_hosts")
+	}
+	flag.StringVar(&knownHostsPath, "known-hosts", knownHosts, "File that pins the key of each TLS server, empty to turn pinning off")
+}
+
+// serverIdentity is what the TLS handshake told us about the server's key.
+type serverIdentity struct {
+	mu          sync.Mutex
+	fingerprint string
+	added       bool
+	changed     *internal.HostKeyChangedError
+}
+
+func (id *serverIdentity) keyChanged() *internal.HostKeyChangedError {
+	if id == nil {
+		return nil
+	}
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.changed
+}
+
+// describe sums up the server's identity for the history view's title.
+func (id *serverIdentity) describe() string {
+	if id == nil {
+		return "not encrypted"
+	}
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	switch {
+	case knownHostsPath == "":
+		return fmt.Sprintf("server key %s", id.fingerprint)
+	case id.added:
+		return fmt.Sprintf("server key %s (new, now pinned)", id.fingerprint)
+	default:
+		return fmt.Sprintf("server key %s (pinned)", id.fingerprint)
+	}
+}
+
+// transportCredentials picks TLS or plaintext based on the --tls flags. Over
+// TLS the server's key is checked against the known hosts file, and the
+// returned serverIdentity is filled in once the handshake is done.
+func transportCredentials(address string) (credentials.TransportCredentials, *serverIdentity, error) {
+	if !useTLS && tlsCA == "" && tlsCert == "" && tlsKey == "" {
+		return insecure.NewCredentials(), nil, nil
+	}
+	config, err := internal.ClientTLSConfig(tlsCA, tlsCert, tlsKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := &serverIdentity{}
+	var knownHosts *internal.KnownHosts
+	if knownHostsPath != "" {
+		knownHosts = internal.NewKnownHosts(knownHostsPath)
+	}
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		fingerprint := internal.CertificateFingerprint(cs.PeerCertificates[0])
+
+		id.mu.Lock()
+		defer id.mu.Unlock()
+		id.fingerprint = fingerprint
+		if knownHosts == nil {
+			return nil
+		}
+		added, err := knownHosts.Check(address, fingerprint)
+		var changed *internal.HostKeyChangedError
+		if errors.As(err, &changed) {
+			id.changed = changed
+		}
+		if err != nil {
+			return err
+		}
+		id.added = id.added || added
+		return nil
+	}
+	return credentials.NewTLS(config), id, nil
+}
+
+// hostKeyWarning takes over the whole screen to say the server's key has
+// changed, and waits for the user to quit.
+func hostKeyWarning(changed *internal.HostKeyChangedError) {
+	g, err := gocui.NewGui(gocui.OutputNormal)
+	if err != nil {
+		log.Panicln(err)
+	}
+	defer g.Close()
+
+	hostKeyChange = changed
+	g.SetManagerFunc(layoutHostKeyWarning)
+
+	if err := g.SetKeybinding("", gocui.KeyCtrlC, gocui.ModNone, quit); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
+		log.Panicln(err)
+	}
+}
+
+// hostKeyChange is the server key change the warning is about, if there has
+// been one. Once the chat is up it is only touched from inside update.
+var hostKeyChange *internal.HostKeyChangedError
+
+// layoutHostKeyWarning covers the screen with the warning about
+// hostKeyChange, if it is set.
+func layoutHostKeyWarning(g *gocui.Gui) error {
+	if hostKeyChange == nil {
+		return nil
+	}
+	maxX, maxY := g.Size()
+	v, err := g.SetView("warning", 1, 1, maxX-1, maxY-1)
+	if err != gocui.ErrUnknownView {
+		return err
+	}
+	v.Title = "WARNING"
+	v.Wrap = true
+	v.BgColor = gocui.ColorRed
+	v.FgColor = gocui.ColorWhite | gocui.AttrBold
+	fmt.Fprintln(v, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintln(v, "@    WARNING: SERVER IDENTIFICATION HAS CHANGED!          @")
+	fmt.Fprintln(v, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintln(v)
+	fmt.Fprintln(v, "Someone could be intercepting your messages, or the server's")
+	fmt.Fprintln(v, "certificate was replaced with a new key. Refusing to connect.")
+	fmt.Fprintln(v)
+	fmt.Fprintf(v, "Server:                %s\n", hostKeyChange.Host)
+	fmt.Fprintf(v, "Pinned fingerprint:    %s\n", hostKeyChange.Known)
+	fmt.Fprintf(v, "Presented fingerprint: %s\n", hostKeyChange.Presented)
+	fmt.Fprintln(v)
+	fmt.Fprintf(v, "If the change is expected, remove the line for %s from %s.\n", hostKeyChange.Host, hostKeyChange.File)
+	fmt.Fprintln(v)
+	fmt.Fprintln(v, "Press Ctrl-C to quit.")
+
+	// It goes over the chat if the key changed while reconnecting, and
+	// nothing typed should reach the chat behind it.
+	if _, err := g.SetViewOnTop("warning"); err != nil {
+		return err
+	}
+	_, err = g.SetCurrentView("warning")
+	return err
 }
 
 func main() {
 
-	flag.Parse()
+	if err := parseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatalf("Error reading config: %s\n", err)
+	}
+
+	// A client certificate can log in on its own with servers that take
+	// it as the user's identity
+	if privateKeyPath == "" && tlsCert == "" {
+		log.Fatal("No key file, pass --keyfile or set key_file in a profile")
+	}
+	var privateKey crypto.Signer
+	if privateKeyPath != "" {
+		// Keys made as in docs/generating_a_key.md are named after the user
+		if username == "" {
+			username = filepath.Base(privateKeyPath)
+		}
+		key, err := readPkFromFile(privateKeyPath)
+		if err != nil {
+			log.Fatalf("Error reading private key: %s\n", err)
+		}
+		privateKey = key
+	}
 
-	// Validate the required --keyfile flag
-	if privateKeyPath == "" {
-		log.Fatal("Missing required --keyfile flag")
+	creds, identity, err := transportCredentials(serverAddress)
+	if err != nil {
+		log.Fatalf("Error loading TLS config: %s\n", err)
 	}
 
-	client, err := createClient("localhost", 50051)
+	client, err := createClient(serverAddress, creds)
 	if err != nil {
 		log.Panic(err)
 	}
-	stream, err := client.Broadcast(context.Background())
+	sess := &session{client: client, address: serverAddress, username: username, privateKey: privateKey, identity: identity}
+	welcome, err := sess.connect(nil)
+	if changed := identity.keyChanged(); changed != nil {
+		hostKeyWarning(changed)
+		os.Exit(1)
+	}
 	if err != nil {
-		fmt.Println("Error receiving messages from server:", err)
-		return
+		log.Fatalf("Error logging in: %s\n", err)
 	}
+	sess.username = welcome.Username
+	serverDescription = identity.describe()
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
 		log.Panicln(err)
@@ -70,101 +281,317 @@ func main() {
 		log.Panicln(err)
 	}
 
-	if err := g.SetKeybinding("message", gocui.KeyEnter, gocui.ModNone, handleMessage(g, stream)); err != nil {
+	if err := g.SetKeybinding("", gocui.KeyCtrlN, gocui.ModNone, cycleConversation(1)); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.SetKeybinding("", gocui.KeyCtrlP, gocui.ModNone, cycleConversation(-1)); err != nil {
+		log.Panicln(err)
+	}
+
+	if err := g.SetKeybinding("message", gocui.KeyPgup, gocui.ModNone, scrollHistory(sess, -1)); err != nil {
+		log.Panicln(err)
+	}
+	if err := g.SetKeybinding("message", gocui.KeyPgdn, gocui.ModNone, scrollHistory(sess, 1)); err != nil {
+		log.Panicln(err)
+	}
+	g.InputEsc = true
+	if err := searchKeybindings(g); err != nil {
+		log.Panicln(err)
+	}
+
+	if err := g.SetKeybinding("message", gocui.KeyEnter, gocui.ModNone, handleMessage(sess)); err != nil {
 		log.Panicln(err)
 	}
+	messageEditor = &typingEditor{sess: sess}
 
-	go listenForMessages(g, stream)
+	go runUpdates(g)
+	setConnection(sess, fmt.Sprintf("connected to %s as %s", serverAddress, sess.username))
+	go listenForMessages(g, sess)
+	go loadUsers(sess)
 
 	if err := g.MainLoop(); err != nil && err != gocui.ErrQuit {
 		log.Panicln(err)
 	}
 }
 
+// serverDescription is shown in the history view's title.
+var serverDescription string
+
+// How wide the channels and users panes on either side of the history are.
+const (
+	channelsWidth = 20
+	usersWidth    = 20
+)
+
 func layout(g *gocui.Gui) error {
 	maxX, maxY := g.Size()
-	if v, err := g.SetView("history", 1, 1, maxX-1, maxY-5); err != nil {
+	if v, err := g.SetView("channels", 1, 1, channelsWidth, maxY-6); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Title = "channels"
+		drawChannels(g)
+	}
+	if _, err := g.SetView("history", channelsWidth+1, 1, maxX-usersWidth-2, maxY-6); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		drawHistory(g)
+	}
+	if v, err := g.SetView("users", maxX-usersWidth-1, 1, maxX-1, maxY-6); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
-		fmt.Fprint(v, "CHAT HISTORY\n\n")
+		v.Title = "online"
+		drawUsers(g)
+	}
+	if err := layoutSearch(g, channelsWidth+1, 1, maxX-usersWidth-2, maxY-6); err != nil {
+		return err
+	}
+	// The status bar is the one line between the history and the message
+	// view, and has no frame of its own.
+	if v, err := g.SetView("status", 1, maxY-6, maxX-1, maxY-4); err != nil {
+		if err != gocui.ErrUnknownView {
+			return err
+		}
+		v.Frame = false
 	}
 	if v, err := g.SetView("message", 1, maxY-4, maxX-1, maxY-1); err != nil {
 		if err != gocui.ErrUnknownView {
 			return err
 		}
 		v.Editable = true
+		v.Editor = messageEditor
 		v.Wrap = true
 		if _, err := g.SetCurrentView("message"); err != nil {
 			return err
 		}
 	}
-	return nil
+	return layoutHostKeyWarning(g)
 }
 
-func handleMessage(g *gocui.Gui, stream pb.MessageService_BroadcastClient) func(*gocui.Gui, *gocui.View) error {
-	privateKeyPath := "/home/neal/workspace/shitchat/scratch/keys/key.pem"
-
-	return func(_ *gocui.Gui, v *gocui.View) error {
-		id := uuid.New().String()
+func handleMessage(sess *session) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, v *gocui.View) error {
 		message := strings.TrimSpace(v.Buffer())
 		v.Clear()
 		v.SetCursor(0, 0)
-		if message != "" {
-			privateKey, err := readPkFromFile(privateKeyPath)
-			if err != nil {
-				log.Fatalf("Error reading private key: %s\n", err)
-				return err
-			}
+		if strings.HasPrefix(message, "/") {
+			runCommand(g, sess, message)
+			return nil
+		}
+		if message != "" && current != nil {
+			return sendMessage(g, sess, current, message)
+		}
+		return nil
+	}
+}
 
-			// Compute the hash of the message
-			hashed := sha256.Sum256([]byte(message))
+// sendMessage signs text and sends it to conversation c, or queues it until
+// the CLI is back online. It runs from a keybinding.
+func sendMessage(g *gocui.Gui, sess *session, c *conversation, text string) error {
+	queued, err := sess.sendMessage(c.channel, c.user, text)
+	if err != nil {
+		return err
+	}
+	if queued {
+		addLine(g, c, fmt.Sprintf("*** offline, will send when reconnected: %s", text))
+		drawStatus(g, sess)
+	}
+	return nil
+}
 
-			// Sign the hash
-			signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
-			if err != nil {
-				log.Fatalf("Error from signing: %s\n", err)
-				return err
-			}
+// sign signs data with privateKey and returns the signature base64 encoded,
+// ready to be sent.
+func sign(privateKey crypto.Signer, data []byte) (string, error) {
+	signature, err := internal.Sign(privateKey, data)
+	if err != nil {
+		return "", err
+	}
 
-			// Convert the signature to a string so it can be sent
-			signatureStr := base64.StdEncoding.EncodeToString(signature)
+	// Convert the signature to a string so it can be sent
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
 
-			// Send the message along with its signature
-			stream.Send(&pb.SendMessageRequest{Id: id, Text: message, Signature: signatureStr, Username: "key.pem"})
+// listenForMessages shows everything the server sends, reconnecting if the
+// stream breaks.
+func listenForMessages(g *gocui.Gui, sess *session) {
+	for {
+		shutdown, err := receive(g, sess, sess.currentStream())
+		unanswered := sess.disconnect()
+		setUsers(nil)
+		var wait time.Duration
+		if shutdown != nil {
+			// The server said goodbye, which beats the error the stream
+			// ended with.
+			wait = time.Duration(shutdown.ReconnectAfter) * time.Millisecond
+			appendHistory(g, fmt.Sprintf("*** %s", shutdown.Text))
+		} else {
+			appendHistory(g, fmt.Sprintf("*** disconnected: %s, reconnecting", status.Convert(err).Message()))
 		}
-		return nil
+		if unanswered > 0 {
+			appendHistory(g, fmt.Sprintf("*** %d sent messages weren't confirmed, sending them again when reconnected", unanswered))
+		}
+		if !reconnect(sess, wait) {
+			appendHistory(g, "*** could not reconnect, restart to try again")
+			return
+		}
+		appendHistory(g, "*** reconnected")
+		go loadUsers(sess)
 	}
 }
 
-func listenForMessages(g *gocui.Gui, stream pb.MessageService_BroadcastClient) {
+// receive handles the events on stream until it breaks. If the server said it
+// was shutting down first, its notice is returned too.
+func receive(g *gocui.Gui, sess *session, stream pb.MessageService_ConnectClient) (*pb.ShutdownNotice, error) {
+	var shutdown *pb.ShutdownNotice
 	for {
-		msg, err := stream.Recv()
-		if err == io.EOF {
-			return
-		}
+		ev, err := stream.Recv()
 		if err != nil {
-			fmt.Println("Error receiving message from server:", err)
-			return
+			return shutdown, err
 		}
-		g.Update(func(g *gocui.Gui) error {
-			historyView, _ := g.View("history")
-			fmt.Fprintln(historyView, msg.Text)
-			// Scroll the history view
-			_, maxY := historyView.Size()
-			linesInBuffer := len(historyView.BufferLines())
-			if linesInBuffer > maxY {
-				_, err := historyView.Line(linesInBuffer - maxY)
-				if err == nil {
-					historyView.SetOrigin(0, linesInBuffer-maxY)
+
+		switch e := ev.Event.(type) {
+		case *pb.ServerEvent_Message:
+			msg := e.Message
+			update(func(g *gocui.Gui) error {
+				if msg.Recipient == "" {
+					if c := findConversation(msg.Channel); c != nil {
+						addMessage(g, c, msg)
+					}
+					return nil
+				}
+				// Direct messages are filed under the other person,
+				// whichever way they went.
+				peer := msg.Sender
+				if peer == sess.username {
+					peer = msg.Recipient
+				}
+				addMessage(g, addDirect(g, peer), msg)
+				return nil
+			})
+		case *pb.ServerEvent_Join:
+			join := e.Join
+			update(func(g *gocui.Gui) error {
+				// The server confirms our own joins the same way it
+				// announces everyone else's.
+				c := findConversation(join.Channel)
+				if c == nil && join.Username == sess.username {
+					c = addConversation(g, join.Channel)
+					switchConversation(g, c)
+				}
+				if c != nil {
+					addLine(g, c, fmt.Sprintf("*** %s joined #%s", join.Username, join.Channel))
 				}
+				return nil
+			})
+		case *pb.ServerEvent_Leave:
+			appendTo(g, e.Leave.Channel, fmt.Sprintf("*** %s left #%s", e.Leave.Username, e.Leave.Channel))
+		case *pb.ServerEvent_Ack:
+			sess.answered(e.Ack.Id)
+		case *pb.ServerEvent_Error:
+			if e.Error.Id != "" {
+				sess.answered(e.Error.Id)
+				appendHistory(g, fmt.Sprintf("message rejected: %s", e.Error.Message))
+			} else {
+				appendHistory(g, fmt.Sprintf("error: %s", e.Error.Message))
 			}
-			return nil
-		})
+		case *pb.ServerEvent_Notice:
+			appendHistory(g, fmt.Sprintf("*** %s", e.Notice.Text))
+		case *pb.ServerEvent_Typing:
+			showTyping(g, e.Typing.Channel, e.Typing.Username)
+		case *pb.ServerEvent_Presence:
+			showPresence(sess, e.Presence.Username, e.Presence.Online)
+		case *pb.ServerEvent_Shutdown:
+			shutdown = e.Shutdown
+		}
+	}
+}
+
+// How often the CLI tells the server the user is typing, and how long it
+// shows someone else as typing after hearing from them.
+const (
+	typingInterval = 3 * time.Second
+	typingTimeout  = 5 * time.Second
+)
+
+// messageEditor is the editor used by the message view.
+var messageEditor gocui.Editor = gocui.DefaultEditor
+
+// typingEditor is gocui's default editor, except it lets the server know
+// while the user is typing.
+type typingEditor struct {
+	sess     *session
+	lastSent time.Time
+}
+
+func (e *typingEditor) Edit(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	if ch != 0 && current != nil && current.user == "" && time.Since(e.lastSent) > typingInterval {
+		e.lastSent = time.Now()
+		e.sess.send(&pb.ClientEvent{Event: &pb.ClientEvent_Typing{Typing: &pb.TypingEvent{Channel: current.channel}}})
+	}
+}
+
+// typist is someone typing in a channel.
+type typist struct {
+	channel  string
+	username string
+}
+
+// typing holds when each typist was last seen typing. It is only touched
+// from inside update.
+var typing = make(map[typist]time.Time)
+
+// showTyping notes that username is typing in channel and shows it in the
+// message view's title until they stop.
+func showTyping(g *gocui.Gui, channel, username string) {
+	update(func(g *gocui.Gui) error {
+		typing[typist{channel, username}] = time.Now()
+		return updateTyping(g)
+	})
+	time.AfterFunc(typingTimeout, func() { update(updateTyping) })
+}
+
+// updateTyping shows who is typing in the current conversation.
+func updateTyping(g *gocui.Gui) error {
+	var names []string
+	for t, seen := range typing {
+		if time.Since(seen) >= typingTimeout {
+			delete(typing, t)
+			continue
+		}
+		if current != nil && t.channel == current.channel {
+			names = append(names, t.username)
+		}
+	}
+	sort.Strings(names)
+
+	v, err := g.View("message")
+	if err != nil {
+		return nil
+	}
+	switch len(names) {
+	case 0:
+		v.Title = ""
+	case 1:
+		v.Title = fmt.Sprintf("%s is typing...", names[0])
+	default:
+		v.Title = fmt.Sprintf("%s are typing...", strings.Join(names, ", "))
 	}
+	return nil
 }
 
-func readPkFromFile(filepath string) (*rsa.PrivateKey, error) {
+// formatMessage renders a message for the history view.
+func formatMessage(msg *pb.SendMessageResponse) string {
+	sender := msg.Sender
+	if msg.SenderDevice != "" && msg.SenderDevice != internal.DefaultLabel {
+		sender = fmt.Sprintf("%s (%s)", msg.Sender, msg.SenderDevice)
+	}
+	sent := time.UnixMilli(msg.Timestamp).Format("15:04")
+	return fmt.Sprintf("[%s] %s: %s", sent, sender, msg.Body)
+}
+
+func readPkFromFile(filepath string) (crypto.Signer, error) {
 	content, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		return nil, err
@@ -173,17 +600,35 @@ func readPkFromFile(filepath string) (*rsa.PrivateKey, error) {
 	if block == nil {
 		return nil, errors.New("no valid PEM data found")
 	}
-	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	var privateKey interface{}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		// Keys made by ssh-keygen, e.g. ~/.ssh/id_ed25519
+		privateKey, err = ssh.ParseRawPrivateKey(content)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, errors.New("passphrase protected OpenSSH keys are not supported")
+		}
+	} else {
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
 	if err != nil {
 		return nil, err
 	}
+	// The ssh package hands back Ed25519 keys as a pointer
+	if key, ok := privateKey.(*ed25519.PrivateKey); ok {
+		privateKey = *key
+	}
 
-	rssPrivateKey, ok := privateKey.(*rsa.PrivateKey)
+	signer, ok := privateKey.(crypto.Signer)
 	if !ok {
-		return nil, errors.New("invalid RSA public key")
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	if err := internal.CheckPublicKey(signer.Public()); err != nil {
+		return nil, err
 	}
 
-	return rssPrivateKey, nil
+	return signer, nil
 }
 
 func quit(g *gocui.Gui, v *gocui.View) error {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	pb "github.com/ngharrington/shitchat/message"
+)
+
+// commandHelp is shown by /help.
+var commandHelp = []string{
+	"/join <channel>    join a channel, or switch to it if already joined",
+	"/leave [channel]   leave a channel, the current one by default",
+	"/msg <user> [text] start direct messages with someone",
+	"/close             close the current direct messages",
+	"/switch <name>     show another channel or @user, Ctrl-N and Ctrl-P also cycle through them",
+	"/channels          list every channel on the server",
+	"/search <words>    search old messages, narrowed with from:user, in:#channel, since:YYYY-MM-DD and until:YYYY-MM-DD",
+	"PgUp and PgDn scroll, loading older messages at the top",
+}
+
+// runCommand handles a line typed into the message view that starts with a
+// slash. It runs from a keybinding, so it may touch the conversations.
+func runCommand(g *gocui.Gui, sess *session, line string) {
+	fields := strings.Fields(line)
+	name, args := fields[0], fields[1:]
+
+	switch name {
+	case "/join":
+		if len(args) != 1 {
+			appendHistory(g, "usage: /join <channel>")
+			return
+		}
+		channel := strings.TrimPrefix(args[0], "#")
+		if c := findConversation(channel); c != nil {
+			switchConversation(g, c)
+			return
+		}
+		// The conversation is started when the server confirms the join.
+		sess.send(&pb.ClientEvent{Event: &pb.ClientEvent_Join{Join: &pb.JoinEvent{Channel: channel}}})
+
+	case "/leave":
+		var c *conversation
+		switch len(args) {
+		case 0:
+			c = current
+		case 1:
+			c = findConversation(strings.TrimPrefix(args[0], "#"))
+		}
+		if c == nil || c.user != "" {
+			appendHistory(g, "usage: /leave [channel], for a channel you are in")
+			return
+		}
+		sess.send(&pb.ClientEvent{Event: &pb.ClientEvent_Leave{Leave: &pb.LeaveEvent{Channel: c.channel}}})
+		removeConversation(g, c)
+
+	case "/msg":
+		if len(args) == 0 {
+			appendHistory(g, "usage: /msg <user> [text]")
+			return
+		}
+		c := addDirect(g, strings.TrimPrefix(args[0], "@"))
+		switchConversation(g, c)
+		if len(args) > 1 {
+			sendMessage(g, sess, c, strings.Join(args[1:], " "))
+		}
+
+	case "/close":
+		if current == nil || current.user == "" {
+			appendHistory(g, "/close is for direct messages, use /leave for channels")
+			return
+		}
+		removeConversation(g, current)
+
+	case "/switch":
+		if len(args) != 1 {
+			appendHistory(g, "usage: /switch <name>")
+			return
+		}
+		var c *conversation
+		if strings.HasPrefix(args[0], "@") {
+			c = findDirect(args[0][1:])
+		} else {
+			c = findConversation(strings.TrimPrefix(args[0], "#"))
+		}
+		if c == nil {
+			appendHistory(g, fmt.Sprintf("no conversation %s, /join or /msg it first", args[0]))
+			return
+		}
+		switchConversation(g, c)
+
+	case "/channels":
+		go listChannels(g, sess)
+
+	case "/search":
+		req, err := parseSearch(args)
+		if err != nil {
+			appendHistory(g, fmt.Sprintf("error: %s", err))
+			return
+		}
+		go search(sess, req, strings.Join(args, " "))
+
+	case "/help":
+		appendHistory(g, strings.Join(commandHelp, "\n"))
+
+	default:
+		appendHistory(g, fmt.Sprintf("unknown command %s, try /help", name))
+	}
+}
+
+// listChannels shows every channel on the server with how many people are
+// in it.
+func listChannels(g *gocui.Gui, sess *session) {
+	resp, err := sess.client.ListChannels(sess.context(), &pb.ListChannelsRequest{})
+	if err != nil {
+		appendHistory(g, fmt.Sprintf("error: could not list channels: %s", err))
+		return
+	}
+	if len(resp.Channels) == 0 {
+		appendHistory(g, "*** no channels")
+		return
+	}
+	// One update for the whole list, so the lines can't come out of order
+	lines := []string{"*** channels:"}
+	for _, channel := range resp.Channels {
+		members := "members"
+		if channel.Members == 1 {
+			members = "member"
+		}
+		lines = append(lines, fmt.Sprintf("***   #%s (%d %s)", channel.Name, channel.Members, members))
+	}
+	appendHistory(g, strings.Join(lines, "\n"))
+}
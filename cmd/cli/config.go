@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/ngharrington/shitchat/internal"
+)
+
+// defaultConfigFile returns where the CLI looks for its config file when
+// --config isn't given, or "" if there is no home directory.
+func defaultConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".shitchat", "config.json")
+}
+
+// parseFlags parses the command line, filling in anything it doesn't set
+// from the profile it picks in the config file.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	// The flags are parsed once to find the config file and profile, and
+	// again once the profile is applied so they win over it.
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var config internal.ClientConfig
+	err := internal.LoadConfigFile(configPath, &config)
+	// Not having the default file is fine, one asked for has to be there
+	if errors.Is(err, fs.ErrNotExist) && !isSet(flags, "config") {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	profile, err := config.Profile(profileName)
+	if err != nil {
+		return err
+	}
+	applyProfile(profile)
+
+	return flags.Parse(args)
+}
+
+// isSet reports whether the flag called name was on the command line.
+func isSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// applyProfile sets the settings the profile has values for.
+func applyProfile(profile internal.Profile) {
+	setString := func(setting *string, value string) {
+		if value != "" {
+			*setting = value
+		}
+	}
+	setString(&serverAddress, profile.Server)
+	setString(&username, profile.Username)
+	setString(&privateKeyPath, profile.KeyFile)
+	useTLS = useTLS || profile.TLS
+	setString(&tlsCA, profile.TLSCA)
+	setString(&tlsCert, profile.TLSCert)
+	setString(&tlsKey, profile.TLSKey)
+	setString(&knownHostsPath, profile.KnownHosts)
+}
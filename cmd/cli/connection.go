@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How long the CLI waits before trying to reconnect, doubling after every
+// failed attempt.
+const (
+	initialBackoff = time.Second
+	maxBackoff     = time.Minute
+)
+
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoff returns how long to wait before the next attempt: a random time
+// between half of delay and all of it, so clients that lost the same server
+// don't all come back at once.
+func backoff(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// reconnect keeps trying to open a new stream until it works, and reports
+// whether it did. It gives up when the server turns the login down, since
+// trying again won't change its mind, and when the server's key has changed.
+// The first attempt waits for about
+// wait, which is how long a server that shut down asked clients to give it.
+func reconnect(sess *session, wait time.Duration) bool {
+	// The conversations can only be read from inside an update
+	points := make(chan []string, 1)
+	update(func(g *gocui.Gui) error {
+		points <- resumePoints()
+		return nil
+	})
+	resume := <-points
+
+	if wait > 0 {
+		// Spread everyone out over the time after the hint, rather than
+		// all coming back at the moment it runs out.
+		wait = backoff(2 * wait)
+		setConnection(sess, fmt.Sprintf("server restarting, reconnecting in %s", wait.Round(time.Second)))
+		time.Sleep(wait)
+	}
+
+	// Only this goroutine logs in once the chat is up, so the epoch can be
+	// read without the lock.
+	epoch := sess.epoch
+	delay := initialBackoff
+	for attempt := 1; ; attempt++ {
+		setConnection(sess, fmt.Sprintf("reconnecting to %s (attempt %d)", sess.address, attempt))
+		welcome, err := sess.connect(resume)
+		if changed := sess.identity.keyChanged(); changed != nil {
+			// The handshake failing looks like any other dropped connection,
+			// but this is no reason to keep trying.
+			update(func(g *gocui.Gui) error {
+				hostKeyChange = changed
+				return nil
+			})
+			setConnection(sess, fmt.Sprintf("offline: the key of %s has changed, refusing to connect", sess.address))
+			return false
+		}
+		if err == nil {
+			if welcome.Epoch != epoch {
+				// Queued before anything from the new stream is shown
+				update(func(g *gocui.Gui) error {
+					restartNumbering(g)
+					return nil
+				})
+			}
+			setConnection(sess, fmt.Sprintf("connected to %s as %s", sess.address, sess.username))
+			return true
+		}
+
+		switch status.Code(err) {
+		case codes.Unauthenticated, codes.PermissionDenied, codes.FailedPrecondition:
+			setConnection(sess, fmt.Sprintf("offline: %s", status.Convert(err).Message()))
+			return false
+		}
+		wait := backoff(delay)
+		setConnection(sess, fmt.Sprintf("offline, retrying in %s: %s", wait.Round(time.Second), status.Convert(err).Message()))
+		time.Sleep(wait)
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+// connection says how the CLI is connected. It is only touched from inside
+// update.
+var connection string
+
+// setConnection shows state in the status bar.
+func setConnection(sess *session, state string) {
+	update(func(g *gocui.Gui) error {
+		connection = state
+		drawStatus(g, sess)
+		return nil
+	})
+}
+
+// drawStatus fills the status bar with how many messages are waiting to be
+// sent and the connection state.
+func drawStatus(g *gocui.Gui, sess *session) {
+	v, err := g.View("status")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	// The count goes first, as the connection state can be a long error
+	if n := sess.queued(); n > 0 {
+		fmt.Fprintf(v, "[%d queued] ", n)
+	}
+	fmt.Fprint(v, connection)
+}
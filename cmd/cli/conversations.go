@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jroimartin/gocui"
+	pb "github.com/ngharrington/shitchat/message"
+)
+
+// conversation is a channel the CLI has joined or direct messages with one
+// user, with everything shown in it so far.
+type conversation struct {
+	// Only one of channel and user is set.
+	channel string
+	user    string
+	lines   []string
+	unread  int
+
+	// oldestID is the oldest message shown, which older pages are loaded
+	// from until the server hands out a cursor. complete is set once there
+	// is nothing older to load.
+	oldestID string
+	cursor   string
+	loading  bool
+	complete bool
+
+	// lastSeq is the sequence number of the newest message shown in a
+	// channel. Direct messages have no sequence numbers, so seen holds their
+	// ids instead to drop the ones sent again after a reconnect.
+	lastSeq uint64
+	seen    map[string]bool
+}
+
+func (c *conversation) title() string {
+	if c.user != "" {
+		return "@" + c.user
+	}
+	return "#" + c.channel
+}
+
+// conversations are listed in the channels pane in the order they were
+// joined, and current is the one shown in the history view. Like typing they
+// are only touched from inside update or a keybinding.
+var (
+	conversations []*conversation
+	current       *conversation
+)
+
+// findConversation returns the conversation for channel, or nil.
+func findConversation(channel string) *conversation {
+	for _, c := range conversations {
+		if c.user == "" && c.channel == channel {
+			return c
+		}
+	}
+	return nil
+}
+
+// findDirect returns the conversation with user, or nil.
+func findDirect(user string) *conversation {
+	for _, c := range conversations {
+		if c.user == user {
+			return c
+		}
+	}
+	return nil
+}
+
+// addConversation returns the conversation for channel, starting one if
+// there isn't one yet.
+func addConversation(g *gocui.Gui, channel string) *conversation {
+	if c := findConversation(channel); c != nil {
+		return c
+	}
+	return startConversation(g, &conversation{channel: channel})
+}
+
+// addDirect returns the conversation with user, starting one if there isn't
+// one yet.
+func addDirect(g *gocui.Gui, user string) *conversation {
+	if c := findDirect(user); c != nil {
+		return c
+	}
+	return startConversation(g, &conversation{user: user})
+}
+
+// startConversation lists c in the channels pane. The first conversation
+// becomes the current one.
+func startConversation(g *gocui.Gui, c *conversation) *conversation {
+	conversations = append(conversations, c)
+	if current == nil {
+		switchConversation(g, c)
+	} else {
+		drawChannels(g)
+	}
+	return c
+}
+
+// removeConversation drops c, moving to another conversation if it was
+// being shown.
+func removeConversation(g *gocui.Gui, conv *conversation) {
+	for i, c := range conversations {
+		if c != conv {
+			continue
+		}
+		conversations = append(conversations[:i], conversations[i+1:]...)
+		if c == current {
+			current = nil
+			if len(conversations) > 0 {
+				switchConversation(g, conversations[0])
+				return
+			}
+			drawHistory(g)
+		}
+		drawChannels(g)
+		return
+	}
+}
+
+// switchConversation shows c in the history view.
+func switchConversation(g *gocui.Gui, c *conversation) {
+	current = c
+	c.unread = 0
+	drawHistory(g)
+	drawChannels(g)
+	updateTyping(g)
+}
+
+// cycleConversation moves delta places through the conversations, wrapping
+// around at either end.
+func cycleConversation(delta int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, _ *gocui.View) error {
+		if len(conversations) == 0 {
+			return nil
+		}
+		i := 0
+		for j, c := range conversations {
+			if c == current {
+				i = j
+			}
+		}
+		i = (i + delta + len(conversations)) % len(conversations)
+		switchConversation(g, conversations[i])
+		return nil
+	}
+}
+
+// appendTo adds a line to channel's conversation. Lines for channels the CLI
+// isn't in are dropped.
+func appendTo(g *gocui.Gui, channel, line string) {
+	update(func(g *gocui.Gui) error {
+		if c := findConversation(channel); c != nil {
+			addLine(g, c, line)
+		}
+		return nil
+	})
+}
+
+// appendHistory adds a line to whichever conversation is being shown.
+func appendHistory(g *gocui.Gui, line string) {
+	update(func(g *gocui.Gui) error {
+		if current != nil {
+			addLine(g, current, line)
+		}
+		return nil
+	})
+}
+
+// addMessage adds a chat message to c, skipping any it has already shown and
+// noting any it has missed.
+func addMessage(g *gocui.Gui, c *conversation, msg *pb.SendMessageResponse) {
+	if c.user != "" {
+		if c.seen[msg.Id] {
+			return
+		}
+		if c.seen == nil {
+			c.seen = make(map[string]bool)
+		}
+		c.seen[msg.Id] = true
+	} else if msg.Seq != 0 {
+		if msg.Seq <= c.lastSeq {
+			return
+		}
+		if c.lastSeq != 0 && msg.Seq > c.lastSeq+1 {
+			addLine(g, c, missed(c.lastSeq+1, msg.Seq-1))
+		}
+		c.lastSeq = msg.Seq
+	}
+
+	if c.oldestID == "" {
+		c.oldestID = msg.Id
+	}
+	addLine(g, c, formatMessage(msg))
+}
+
+// missed describes messages from seq first to last that could not be
+// fetched.
+func missed(first, last uint64) string {
+	if first == last {
+		return fmt.Sprintf("*** missed message %d, it could not be fetched", first)
+	}
+	return fmt.Sprintf("*** missed %d messages (%d to %d), they could not be fetched", last-first+1, first, last)
+}
+
+// restartNumbering forgets the sequence numbers seen in every channel, for
+// when the server's numbering has started over and they no longer mean
+// anything.
+func restartNumbering(g *gocui.Gui) {
+	for _, c := range conversations {
+		if c.user == "" && c.lastSeq != 0 {
+			c.lastSeq = 0
+			addLine(g, c, "*** the server lost its history, messages sent while offline are gone")
+		}
+	}
+}
+
+// resumePoints lists the channels to rejoin after reconnecting, with the
+// last sequence number seen in each.
+func resumePoints() []string {
+	var points []string
+	for _, c := range conversations {
+		if c.user == "" {
+			points = append(points, fmt.Sprintf("%s=%d", c.channel, c.lastSeq))
+		}
+	}
+	return points
+}
+
+// addLine adds a line to c, showing it straight away if c is the current
+// conversation and counting it as unread otherwise. The history view only
+// follows new lines if it was already scrolled to the bottom.
+func addLine(g *gocui.Gui, c *conversation, line string) {
+	c.lines = append(c.lines, line)
+	if c != current {
+		c.unread++
+		drawChannels(g)
+		return
+	}
+	historyView, err := g.View("history")
+	if err != nil {
+		return
+	}
+	follow := atBottom(historyView)
+	fmt.Fprintln(historyView, line)
+	if follow {
+		scrollToBottom(historyView)
+	}
+}
+
+// drawHistory fills the history view with the current conversation.
+func drawHistory(g *gocui.Gui) {
+	historyView, err := g.View("history")
+	if err != nil {
+		return
+	}
+	historyView.Clear()
+	if current == nil {
+		historyView.Title = serverDescription
+		fmt.Fprintln(historyView, "Not in any channels, /join one.")
+		return
+	}
+	historyView.Title = fmt.Sprintf("%s | %s", current.title(), serverDescription)
+	for _, line := range current.lines {
+		fmt.Fprintln(historyView, line)
+	}
+	scrollToBottom(historyView)
+}
+
+// drawChannels lists the conversations in the channels pane, marking the
+// current one and any with unread messages.
+func drawChannels(g *gocui.Gui) {
+	v, err := g.View("channels")
+	if err != nil {
+		return
+	}
+	v.Clear()
+	for _, c := range conversations {
+		marker := " "
+		if c == current {
+			marker = ">"
+		}
+		if c.unread > 0 {
+			fmt.Fprintf(v, "%s%s (%d)\n", marker, c.title(), c.unread)
+		} else {
+			fmt.Fprintf(v, "%s%s\n", marker, c.title())
+		}
+	}
+}
+
+// atBottom reports whether v's last line is in view.
+func atBottom(v *gocui.View) bool {
+	_, height := v.Size()
+	_, y := v.Origin()
+	return y+height >= len(v.BufferLines())
+}
+
+// scrollToBottom scrolls v so its last line is in view.
+func scrollToBottom(v *gocui.View) {
+	_, maxY := v.Size()
+	linesInBuffer := len(v.BufferLines())
+	if linesInBuffer > maxY {
+		_, err := v.Line(linesInBuffer - maxY)
+		if err == nil {
+			v.SetOrigin(0, linesInBuffer-maxY)
+		}
+	}
+}
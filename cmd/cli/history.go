@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	pb "github.com/ngharrington/shitchat/message"
+)
+
+// historyPageSize is how many older messages are loaded at a time.
+const historyPageSize = 50
+
+// scrollHistory moves the history view by pages screenfuls, loading older
+// messages when it reaches the top.
+func scrollHistory(sess *session, pages int) func(*gocui.Gui, *gocui.View) error {
+	return func(g *gocui.Gui, _ *gocui.View) error {
+		v, err := g.View("history")
+		if err != nil || current == nil {
+			return nil
+		}
+		_, height := v.Size()
+		_, y := v.Origin()
+
+		y += pages * (height - 1)
+		if bottom := len(v.BufferLines()) - height; y > bottom {
+			y = bottom
+		}
+		if y <= 0 {
+			y = 0
+			if pages < 0 {
+				loadOlder(sess, current)
+			}
+		}
+		return v.SetOrigin(0, y)
+	}
+}
+
+// loadOlder fetches the page of messages before the oldest one in c and adds
+// it to the top.
+func loadOlder(sess *session, c *conversation) {
+	if c.loading || c.complete {
+		return
+	}
+	c.loading = true
+
+	req := &pb.HistoryRequest{Channel: c.channel, User: c.user, Cursor: c.cursor, PageSize: historyPageSize}
+	if c.cursor == "" {
+		req.BeforeId = c.oldestID
+	}
+	go func() {
+		resp, err := sess.client.History(sess.context(), req)
+		update(func(g *gocui.Gui) error {
+			c.loading = false
+			if err != nil {
+				addLine(g, c, fmt.Sprintf("error: could not load older messages: %s", err))
+				return nil
+			}
+
+			var lines []string
+			if resp.NextCursor == "" {
+				c.complete = true
+				lines = append(lines, "--- start of history ---")
+			}
+			for _, msg := range resp.Messages {
+				lines = append(lines, formatMessage(msg))
+			}
+			if len(resp.Messages) > 0 {
+				c.oldestID = resp.Messages[0].Id
+			}
+			c.cursor = resp.NextCursor
+			c.lines = append(lines, c.lines...)
+
+			if c == current {
+				drawHistory(g)
+				// Keep the line that was at the top where it was, with the
+				// new page above it.
+				if v, err := g.View("history"); err == nil {
+					_, height := v.Size()
+					added := 0
+					for _, line := range lines {
+						added += strings.Count(line, "\n") + 1
+					}
+					if y := added - height + 1; y > 0 {
+						v.SetOrigin(0, y)
+					} else {
+						v.SetOrigin(0, 0)
+					}
+				}
+			}
+			return nil
+		})
+	}()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	pb "github.com/ngharrington/shitchat/message"
+)
+
+// searchDateFormat is how since: and until: dates are written in a search.
+const searchDateFormat = "2006-01-02"
+
+// The search view covers the history view while searchOpen is set. Like the
+// conversations these are only touched from inside update or a keybinding.
+var (
+	searchOpen  bool
+	searchTitle string
+	searchLines []string
+)
+
+// parseSearch turns the arguments to /search into a request. Words are
+// searched for, and from:user, in:#channel, since:YYYY-MM-DD and
+// until:YYYY-MM-DD narrow the search down. Both dates are inclusive.
+func parseSearch(args []string) (*pb.SearchRequest, error) {
+	req := &pb.SearchRequest{}
+	var words []string
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, ":")
+		if !ok || value == "" {
+			words = append(words, arg)
+			continue
+		}
+		switch key {
+		case "from":
+			req.Sender = strings.TrimPrefix(value, "@")
+		case "in":
+			req.Channel = strings.TrimPrefix(value, "#")
+		case "since", "until":
+			day, err := time.ParseInLocation(searchDateFormat, value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("%s: dates are written like %s", key, searchDateFormat)
+			}
+			if key == "since" {
+				req.Since = day.UnixMilli()
+			} else {
+				req.Until = day.AddDate(0, 0, 1).UnixMilli()
+			}
+		default:
+			words = append(words, arg)
+		}
+	}
+	req.Query = strings.Join(words, " ")
+	return req, nil
+}
+
+// search runs req on the server and opens the results in the search view.
+func search(sess *session, req *pb.SearchRequest, title string) {
+	resp, err := sess.client.Search(sess.context(), req)
+	update(func(g *gocui.Gui) error {
+		if err != nil {
+			if current != nil {
+				addLine(g, current, fmt.Sprintf("error: search failed: %s", err))
+			}
+			return nil
+		}
+
+		searchLines = searchLines[:0]
+		for _, msg := range resp.Messages {
+			where := "#" + msg.Channel
+			if msg.Recipient != "" {
+				where = "@" + msg.Recipient
+			}
+			searchLines = append(searchLines, fmt.Sprintf("%-12s %s", where, formatSearchResult(msg)))
+		}
+		if len(searchLines) == 0 {
+			searchLines = append(searchLines, "Nothing found.")
+		}
+		searchTitle = fmt.Sprintf("search: %s (%d found, Esc to close)", title, len(resp.Messages))
+		searchOpen = true
+
+		// Let layout draw it afresh
+		g.DeleteView("search")
+		return nil
+	})
+}
+
+// formatSearchResult is formatMessage with the date, as results can be from
+// any day.
+func formatSearchResult(msg *pb.SendMessageResponse) string {
+	return time.UnixMilli(msg.Timestamp).Format("2006-01-02 ") + formatMessage(msg)
+}
+
+// layoutSearch draws the search view over the history view while a search
+// is open.
+func layoutSearch(g *gocui.Gui, x0, y0, x1, y1 int) error {
+	if !searchOpen {
+		return nil
+	}
+	v, err := g.SetView("search", x0, y0, x1, y1)
+	if err != gocui.ErrUnknownView {
+		return err
+	}
+	v.Title = searchTitle
+	for _, line := range searchLines {
+		fmt.Fprintln(v, line)
+	}
+	if _, err := g.SetCurrentView("search"); err != nil {
+		return err
+	}
+	_, err = g.SetViewOnTop("search")
+	return err
+}
+
+// closeSearch goes back to the conversation.
+func closeSearch(g *gocui.Gui, _ *gocui.View) error {
+	searchOpen = false
+	if err := g.DeleteView("search"); err != nil {
+		return err
+	}
+	_, err := g.SetCurrentView("message")
+	return err
+}
+
+// scrollSearch moves the search results by lines.
+func scrollSearch(lines int) func(*gocui.Gui, *gocui.View) error {
+	return func(_ *gocui.Gui, v *gocui.View) error {
+		_, height := v.Size()
+		_, y := v.Origin()
+		y += lines
+		if bottom := len(v.BufferLines()) - height; y > bottom {
+			y = bottom
+		}
+		if y < 0 {
+			y = 0
+		}
+		return v.SetOrigin(0, y)
+	}
+}
+
+// searchKeybindings lets the search view be scrolled and closed.
+func searchKeybindings(g *gocui.Gui) error {
+	bindings := []struct {
+		key     interface{}
+		handler func(*gocui.Gui, *gocui.View) error
+	}{
+		{gocui.KeyEsc, closeSearch},
+		{'q', closeSearch},
+		{gocui.KeyArrowUp, scrollSearch(-1)},
+		{gocui.KeyArrowDown, scrollSearch(1)},
+		{gocui.KeyPgup, scrollSearch(-10)},
+		{gocui.KeyPgdn, scrollSearch(10)},
+	}
+	for _, b := range bindings {
+		if err := g.SetKeybinding("search", b.key, gocui.ModNone, b.handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ngharrington/shitchat/internal"
+	pb "github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// loginTimeout is how long the server gets to log a new stream in before the
+// CLI gives up on it.
+const loginTimeout = 10 * time.Second
+
+var errNotConnected = errors.New("not connected")
+
+// session is a logged in Connect stream, which is replaced whenever the CLI
+// reconnects.
+type session struct {
+	client     pb.MessageServiceClient
+	address    string
+	username   string
+	privateKey crypto.Signer // nil when logging in by client certificate
+	// identity is the server's TLS identity, nil over plaintext.
+	identity *serverIdentity
+
+	mu     sync.Mutex
+	stream pb.MessageService_ConnectClient
+	cancel context.CancelFunc
+	// token lets the unary RPCs act for the stream's user.
+	token string
+	// epoch is the server's message numbering as of the last login.
+	epoch string
+	// outbox holds the messages typed while there was no stream, in order.
+	// unacked holds the ones sent on the current stream that the server
+	// hasn't answered yet, which go back in the outbox if it breaks.
+	outbox  []outgoing
+	unacked []outgoing
+}
+
+// outgoing is a chat message waiting to be signed and sent. Its id stays the
+// same however many times it is sent, so the server can tell a resend from
+// a new message.
+type outgoing struct {
+	id        string
+	channel   string
+	recipient string
+	text      string
+}
+
+// connect opens a new stream and logs in on it, then sends anything that was
+// typed while the CLI was offline. resume lists the channels to pick up where
+// the last stream left off, as "channel=seq".
+func (s *session) connect(resume []string) (*pb.Welcome, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, point := range resume {
+		ctx = metadata.AppendToOutgoingContext(ctx, "resume", point)
+	}
+	if s.epoch != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "epoch", s.epoch)
+	}
+	// A server that takes the connection but never answers would otherwise
+	// hang the login forever.
+	timer := time.AfterFunc(loginTimeout, cancel)
+	stream, err := s.client.Connect(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	welcome, err := login(stream, s.address, s.username, s.privateKey)
+	if !timer.Stop() && err == nil {
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream, s.cancel, s.token, s.epoch = stream, cancel, welcome.Session, welcome.Epoch
+	// Holding s.mu keeps anything typed now from overtaking the outbox.
+	for len(s.outbox) > 0 {
+		ev, err := s.signMessage(s.outbox[0])
+		if err == nil {
+			err = send(stream, ev)
+		}
+		if err != nil {
+			// Most likely the stream is already broken, so the rest
+			// wait for the next one.
+			break
+		}
+		s.unacked = append(s.unacked, s.outbox[0])
+		s.outbox = s.outbox[1:]
+	}
+	return welcome, nil
+}
+
+// disconnect drops the current stream. Messages sent until the next connect
+// are queued, and so are the ones the server never answered, as the stream
+// may have broken before they got there. It returns how many of those there
+// were.
+func (s *session) disconnect() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.stream, s.cancel = nil, nil
+
+	// They keep their ids when they are resent, so the server only acks
+	// one that did get there but whose ack was lost.
+	n := len(s.unacked)
+	s.outbox, s.unacked = append(s.unacked, s.outbox...), nil
+	return n
+}
+
+// answered forgets the message sent with id, which the server has accepted
+// or rejected.
+func (s *session) answered(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, u := range s.unacked {
+		if u.id == id {
+			s.unacked = append(s.unacked[:i], s.unacked[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *session) currentStream() pb.MessageService_ConnectClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream
+}
+
+// send stamps ev with the protocol version and sends it.
+func (s *session) send(ev *pb.ClientEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream == nil {
+		return errNotConnected
+	}
+	return send(s.stream, ev)
+}
+
+// sendMessage signs a chat message and sends it, or queues it for the next
+// stream if there isn't one. Only one of channel and recipient is set.
+func (s *session) sendMessage(channel, recipient, text string) (queued bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := outgoing{id: uuid.New().String(), channel: channel, recipient: recipient, text: text}
+	if s.stream == nil {
+		s.outbox = append(s.outbox, msg)
+		return true, nil
+	}
+	ev, err := s.signMessage(msg)
+	if err != nil {
+		return false, err
+	}
+	if err := send(s.stream, ev); err != nil {
+		// The stream broke under us; the message goes out on the next
+		// one.
+		s.outbox = append(s.outbox, msg)
+		return true, nil
+	}
+	s.unacked = append(s.unacked, msg)
+	return false, nil
+}
+
+// queued returns how many messages are waiting for a stream.
+func (s *session) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.outbox)
+}
+
+// signMessage turns msg into a signed event. Queued messages are signed when
+// they are finally sent, and again each time they are resent, so the server
+// doesn't see a stale timestamp.
+func (s *session) signMessage(msg outgoing) (*pb.ClientEvent, error) {
+	id := msg.id
+	timestamp := time.Now().UnixMilli()
+	payload := internal.MessagePayload(id, s.username, timestamp, msg.channel, msg.text)
+	if msg.recipient != "" {
+		payload = internal.DirectMessagePayload(id, s.username, timestamp, msg.recipient, msg.text)
+	}
+	// Without a key the stream logged in by certificate, and the server
+	// doesn't check signatures on those
+	var signature string
+	if s.privateKey != nil {
+		var err error
+		if signature, err = sign(s.privateKey, payload); err != nil {
+			return nil, err
+		}
+	}
+	req := &pb.SendMessageRequest{Id: id, Text: msg.text, Signature: signature, Timestamp: timestamp, Channel: msg.channel, Recipient: msg.recipient}
+	return &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: req}}, nil
+}
+
+// context returns a context for unary calls that carries the session token.
+func (s *session) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return metadata.AppendToOutgoingContext(context.Background(), "session", s.token)
+}
+
+// channelBinding returns the internal.ChannelBinding of the stream with ctx,
+// or nil if it isn't over TLS.
+func channelBinding(ctx context.Context) []byte {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return internal.ChannelBinding(tlsInfo.State)
+}
+
+// send stamps ev with the protocol version and sends it.
+func send(stream pb.MessageService_ConnectClient, ev *pb.ClientEvent) error {
+	ev.Version = internal.ProtocolVersion
+	return stream.Send(ev)
+}
+
+// login answers the challenge the server sends at the start of every stream
+// and returns the server's welcome, which says who the stream is logged in
+// as. The answer is only good for address, the server the CLI dialed, and
+// over TLS only for this connection.
+func login(stream pb.MessageService_ConnectClient, address, username string, privateKey crypto.Signer) (*pb.Welcome, error) {
+	ev, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	challenge := ev.GetChallenge()
+	if challenge == nil {
+		return nil, errors.New("server did not send a login challenge")
+	}
+
+	// The server already knows who we are from our client certificate when
+	// it sends an identity, so there is nothing to answer.
+	if challenge.Identity == "" {
+		if privateKey == nil {
+			return nil, errors.New("server asked for a key login but no --keyfile was given")
+		}
+		payload := internal.LoginPayload(challenge.Nonce, address, channelBinding(stream.Context()))
+		signature, err := sign(privateKey, payload)
+		if err != nil {
+			return nil, err
+		}
+		login := &pb.LoginRequest{Username: username, Signature: signature, Server: address}
+		if err := send(stream, &pb.ClientEvent{Event: &pb.ClientEvent_Login{Login: login}}); err != nil {
+			return nil, err
+		}
+	}
+
+	ev, err = stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	welcome := ev.GetWelcome()
+	if welcome == nil {
+		return nil, errors.New("server did not confirm the login")
+	}
+	return welcome, nil
+}
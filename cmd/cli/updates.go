@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jroimartin/gocui"
+)
+
+// gocui's Update hands each function to its own goroutine, so two updates
+// queued one after the other can run in either order. Everything that
+// changes the views goes through update instead, which runs them in order.
+var (
+	updatesMu sync.Mutex
+	pending   []func(*gocui.Gui) error
+	wake      = make(chan struct{}, 1)
+)
+
+// update queues f to run on gocui's main loop after every update queued
+// before it. It never blocks, so it is safe to call from a keybinding.
+func update(f func(*gocui.Gui) error) {
+	updatesMu.Lock()
+	pending = append(pending, f)
+	updatesMu.Unlock()
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// runUpdates feeds queued updates to g, waiting for each batch to run before
+// handing over the next.
+func runUpdates(g *gocui.Gui) {
+	for range wake {
+		updatesMu.Lock()
+		batch := pending
+		pending = nil
+		updatesMu.Unlock()
+
+		done := make(chan struct{})
+		g.Update(func(g *gocui.Gui) error {
+			defer close(done)
+			for _, f := range batch {
+				if err := f(g); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		<-done
+	}
+}
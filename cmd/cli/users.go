@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jroimartin/gocui"
+	"github.com/ngharrington/shitchat/internal"
+	pb "github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/status"
+)
+
+// online holds who the server says is online. It is only touched from inside
+// update.
+var online = make(map[string]bool)
+
+// loadUsers asks the server who is online and fills the users pane. Changes
+// after that arrive as presence events.
+func loadUsers(sess *session) {
+	resp, err := sess.client.Who(sess.context(), &pb.WhoRequest{})
+	if err != nil {
+		update(func(g *gocui.Gui) error {
+			if current != nil {
+				addLine(g, current, fmt.Sprintf("could not list users: %s", status.Convert(err).Message()))
+			}
+			return nil
+		})
+		return
+	}
+	var usernames []string
+	for _, user := range resp.Users {
+		usernames = append(usernames, user.Username)
+	}
+	setUsers(usernames)
+}
+
+// setUsers replaces everyone in the users pane with usernames.
+func setUsers(usernames []string) {
+	update(func(g *gocui.Gui) error {
+		online = make(map[string]bool)
+		for _, username := range usernames {
+			online[username] = true
+		}
+		drawUsers(g)
+		return nil
+	})
+}
+
+// showPresence updates the users pane when someone comes online or goes
+// offline, and says so in the default channel.
+func showPresence(sess *session, username string, isOnline bool) {
+	update(func(g *gocui.Gui) error {
+		if online[username] == isOnline {
+			return nil
+		}
+		if isOnline {
+			online[username] = true
+		} else {
+			delete(online, username)
+		}
+		drawUsers(g)
+
+		if c := findConversation(internal.DefaultChannel); c != nil && username != sess.username {
+			if isOnline {
+				addLine(g, c, fmt.Sprintf("*** %s is online", username))
+			} else {
+				addLine(g, c, fmt.Sprintf("*** %s went offline", username))
+			}
+		}
+		return nil
+	})
+}
+
+// drawUsers fills the users pane with everyone online.
+func drawUsers(g *gocui.Gui) {
+	v, err := g.View("users")
+	if err != nil {
+		return
+	}
+	var usernames []string
+	for username := range online {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	v.Clear()
+	v.Title = fmt.Sprintf("online (%d)", len(usernames))
+	for _, username := range usernames {
+		fmt.Fprintln(v, username)
+	}
+}
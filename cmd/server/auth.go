@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// nonceSize is the number of random bytes in a login challenge.
+const nonceSize = 32
+
+// sessionSize is the number of random bytes in a session token, and
+// sessionMetadata the metadata key unary RPCs carry it in.
+const (
+	sessionSize     = 32
+	sessionMetadata = "session"
+)
+
+// login runs the challenge-response handshake at the start of a stream and
+// returns a client for the user the stream is bound to.
+func (s *server) login(conn conn) (*client, error) {
+	if s.certIdentity {
+		if username := certificateIdentity(conn.Context()); username != "" {
+			if err := conn.Send(&message.ServerEvent{Event: &message.ServerEvent_Challenge{Challenge: &message.LoginChallenge{Identity: username}}}); err != nil {
+				return nil, err
+			}
+			log.Printf("%s logged in by certificate", username)
+			return &client{username: username, device: "certificate"}, nil
+		}
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, status.Error(codes.Internal, "could not generate login challenge")
+	}
+	if err := conn.Send(&message.ServerEvent{Event: &message.ServerEvent_Challenge{Challenge: &message.LoginChallenge{Nonce: nonce}}}); err != nil {
+		return nil, err
+	}
+
+	ev, err := conn.Recv()
+	if err != nil {
+		return nil, err
+	}
+	login := ev.GetLogin()
+	if login == nil {
+		return nil, status.Error(codes.Unauthenticated, "expected a login request")
+	}
+
+	if !s.isServerName(login.Server) {
+		return nil, status.Errorf(codes.PermissionDenied, "this server is not %s", login.Server)
+	}
+	payload := internal.LoginPayload(nonce, login.Server, channelBinding(conn.Context()))
+	key, err := s.authenticator.Authenticate(login.Username, login.Signature, payload)
+	if err != nil {
+		return nil, authError(login.Username, err)
+	}
+	log.Printf("%s logged in from %s with key %s", key.Username, key.Label, key.Fingerprint)
+	return &client{username: key.Username, key: key, device: key.Label}, nil
+}
+
+// isServerName reports whether address is one clients may reach the server
+// by. Anything goes if no names are configured.
+func (s *server) isServerName(address string) bool {
+	if len(s.serverNames) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	for _, name := range s.serverNames {
+		if name == address || name == host {
+			return true
+		}
+	}
+	return false
+}
+
+// channelBinding returns the internal.ChannelBinding of ctx's connection, or
+// nil if it isn't over TLS.
+func channelBinding(ctx context.Context) []byte {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return internal.ChannelBinding(tlsInfo.State)
+}
+
+// certificateIdentity returns the common name of the verified client
+// certificate on ctx's connection, or "" if there isn't one.
+func certificateIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+}
+
+// checkKeys disconnects every stream whose key has been revoked, removed or
+// has expired since it logged in.
+func (s *server) checkKeys() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, clients := range s.clients {
+		for _, c := range clients {
+			if c.key == nil {
+				continue
+			}
+			if err := s.authenticator.Check(c.key); err != nil {
+				c.disconnect(authError(c.username, err))
+			}
+		}
+	}
+}
+
+// authenticate checks that msg was signed with the key c logged in with,
+// then makes sure it is fresh and has not been seen before. It returns a gRPC
+// status error describing why msg was rejected, or nil if it may be relayed.
+func (s *server) authenticate(c *client, msg *message.SendMessageRequest) error {
+	username := c.username
+
+	// Streams identified by their certificate are already authenticated by
+	// TLS, so there is no key to check a signature against.
+	if c.key != nil {
+		payload := internal.MessagePayload(msg.Id, username, msg.Timestamp, msg.Channel, msg.Text)
+		if msg.Recipient != "" {
+			payload = internal.DirectMessagePayload(msg.Id, username, msg.Timestamp, msg.Recipient, msg.Text)
+		}
+		key, err := s.authenticator.Authenticate(username, msg.Signature, payload)
+		if err != nil {
+			return authError(username, err)
+		}
+		if key.Fingerprint != c.key.Fingerprint {
+			return status.Errorf(codes.PermissionDenied, "message was signed with %s's %s key but this stream logged in with %s", username, key.Label, c.key.Label)
+		}
+	}
+
+	sent := time.UnixMilli(msg.Timestamp)
+	if skew := time.Since(sent); skew > s.maxClockSkew || skew < -s.maxClockSkew {
+		return status.Errorf(codes.Unauthenticated, "message timestamp is %s away from the server clock", skew.Round(time.Second))
+	}
+	if msg.Id == "" {
+		return status.Error(codes.InvalidArgument, "message has no id")
+	}
+	if !s.replays.Check(username, msg.Id, sent) {
+		return status.Errorf(codes.Unauthenticated, "message %s has already been sent", msg.Id)
+	}
+	return nil
+}
+
+// authError turns an error from the authenticator into a gRPC status.
+func authError(username string, err error) error {
+	switch {
+	case errors.Is(err, internal.ErrUnknownUser):
+		return status.Errorf(codes.PermissionDenied, "user %q is not registered", username)
+	case errors.Is(err, internal.ErrKeyRevoked):
+		return status.Errorf(codes.PermissionDenied, "the key for user %q has been revoked", username)
+	case errors.Is(err, internal.ErrKeyExpired):
+		return status.Errorf(codes.PermissionDenied, "the key for user %q has expired", username)
+	case errors.Is(err, internal.ErrKeyNotYetValid):
+		return status.Errorf(codes.PermissionDenied, "the key for user %q is not valid yet", username)
+	default:
+		return status.Errorf(codes.Unauthenticated, "signature for user %q could not be verified", username)
+	}
+}
+
+// newSession returns a token that lets c's owner make unary calls for as long
+// as c's stream stays open.
+func (s *server) newSession(c *client) (string, error) {
+	token := make([]byte, sessionSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", status.Error(codes.Internal, "could not generate session")
+	}
+	c.session = base64.RawURLEncoding.EncodeToString(token)
+
+	s.mu.Lock()
+	s.sessions[c.session] = c
+	s.mu.Unlock()
+	return c.session, nil
+}
+
+// sessionClient is the context key the stream behind a unary call's session
+// is stored under.
+type sessionClient struct{}
+
+// sessionInterceptor refuses unary calls that don't carry the session of an
+// open stream, and hands the stream's client to the handler.
+func (s *server) sessionInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(sessionMetadata)
+	if len(tokens) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "no session, log in on a Connect stream first")
+	}
+
+	s.mu.Lock()
+	c := s.sessions[tokens[0]]
+	s.mu.Unlock()
+	if c == nil {
+		return nil, status.Error(codes.Unauthenticated, "session has ended")
+	}
+	return handler(context.WithValue(ctx, sessionClient{}, c), req)
+}
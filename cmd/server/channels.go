@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// channelName is what a channel may be called.
+var channelName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// channelOrDefault returns the channel an event is for, treating an empty
+// name as the default channel.
+func channelOrDefault(channel string) string {
+	if channel == "" {
+		return internal.DefaultChannel
+	}
+	return channel
+}
+
+// join adds c to channel and announces it to everyone already there, c
+// included so it knows the join went through. c is then sent the channel's
+// recent history, or everything after afterSeq if it is resuming the channel
+// after a reconnect.
+func (s *server) join(c *client, channel string, afterSeq uint64) error {
+	if !channelName.MatchString(channel) {
+		return status.Errorf(codes.InvalidArgument, "%q is not a valid channel name, use 1 to 32 of a-z, 0-9, _ and -", channel)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.channels[channel]
+	if members[c] {
+		return status.Errorf(codes.AlreadyExists, "already in #%s", channel)
+	}
+	if members == nil {
+		members = make(map[*client]bool)
+		s.channels[channel] = members
+	}
+	members[c] = true
+
+	ev := &message.ServerEvent{Event: &message.ServerEvent_Join{Join: &message.JoinEvent{Channel: channel, Username: c.username}}}
+	for member := range members {
+		member.send(ev)
+	}
+	if afterSeq == 0 {
+		s.sendHistory(c, channel)
+	} else {
+		s.sendBackfill(c, channel, afterSeq)
+	}
+	return nil
+}
+
+// leave removes c from channel, telling the rest of the channel and c.
+func (s *server) leave(c *client, channel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members := s.channels[channel]
+	if !members[c] {
+		return status.Errorf(codes.NotFound, "not in #%s", channel)
+	}
+
+	ev := &message.ServerEvent{Event: &message.ServerEvent_Leave{Leave: &message.LeaveEvent{Channel: channel, Username: c.username}}}
+	for member := range members {
+		member.send(ev)
+	}
+	s.removeMember(c, channel)
+	return nil
+}
+
+// removeMember takes c out of channel, dropping the channel once it is empty
+// unless it is the default one. s.mu must be held.
+func (s *server) removeMember(c *client, channel string) {
+	members := s.channels[channel]
+	delete(members, c)
+	if len(members) == 0 && channel != internal.DefaultChannel {
+		delete(s.channels, channel)
+	}
+}
+
+// isMember reports whether c has joined channel.
+func (s *server) isMember(c *client, channel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channels[channel][c]
+}
+
+// joined returns the channels c is a member of.
+func (s *server) joined(c *client) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	channels := make(map[string]bool)
+	for name, members := range s.channels {
+		if members[c] {
+			channels[name] = true
+		}
+	}
+	return channels
+}
+
+func (s *server) ListChannels(ctx context.Context, req *message.ListChannelsRequest) (*message.ListChannelsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &message.ListChannelsResponse{}
+	for name, members := range s.channels {
+		// Count people rather than streams, someone on two devices is still
+		// one member.
+		users := make(map[string]bool)
+		for member := range members {
+			users[member.username] = true
+		}
+		resp.Channels = append(resp.Channels, &message.Channel{Name: name, Members: uint32(len(users))})
+	}
+	sort.Slice(resp.Channels, func(i, j int) bool { return resp.Channels[i].Name < resp.Channels[j].Name })
+	return resp, nil
+}
+
+// resumeMetadata is the metadata key a reconnecting stream lists the
+// channels it was in under, as "channel=seq" with the last sequence number
+// it saw. epochMetadata is the store epoch those numbers are from.
+const (
+	resumeMetadata = "resume"
+	epochMetadata  = "epoch"
+)
+
+// resumePoints reads the channels a stream wants to resume from its
+// metadata. Anything that doesn't parse is skipped. Sequence numbers from
+// another epoch than the store's mean nothing, so the stream starts those
+// channels afresh.
+func resumePoints(ctx context.Context, epoch string) map[string]uint64 {
+	points := make(map[string]uint64)
+	md, _ := metadata.FromIncomingContext(ctx)
+	sameEpoch := false
+	if epochs := md.Get(epochMetadata); len(epochs) > 0 {
+		sameEpoch = epochs[0] == epoch
+	}
+	for _, value := range md.Get(resumeMetadata) {
+		channel, seq, ok := strings.Cut(value, "=")
+		n, err := strconv.ParseUint(seq, 10, 64)
+		if ok && err == nil {
+			if !sameEpoch {
+				n = 0
+			}
+			points[channel] = n
+		}
+	}
+	return points
+}
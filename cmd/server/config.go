@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ngharrington/shitchat/internal"
+)
+
+// envPrefix starts the environment variable for each flag, e.g.
+// SHITCHAT_TLS_CERT for --tls-cert.
+const envPrefix = "SHITCHAT_"
+
+// bindFlags registers a flag for every setting in config, defaulting to what
+// config holds now.
+func bindFlags(fs *flag.FlagSet, config *internal.ServerConfig) {
+	fs.StringVar(&config.Listen, "listen", config.Listen, "Address to serve on")
+	fs.StringVar(&config.PublicKeyPath, "key-dir", config.PublicKeyPath, "Directory of the public keys users log in with")
+	fs.DurationVar((*time.Duration)(&config.KeyReloadInterval), "key-reload-interval", time.Duration(config.KeyReloadInterval), "How often to check the key directory for changes (0 only reloads on SIGHUP)")
+	fs.DurationVar((*time.Duration)(&config.KeyCheckInterval), "key-check-interval", time.Duration(config.KeyCheckInterval), "How often to disconnect streams whose keys have expired")
+
+	fs.StringVar(&config.TLS.Cert, "tls-cert", config.TLS.Cert, "Path to the server's TLS certificate, serves plaintext if empty")
+	fs.StringVar(&config.TLS.Key, "tls-key", config.TLS.Key, "Path to the server's TLS private key")
+	fs.StringVar(&config.TLS.ClientCA, "tls-client-ca", config.TLS.ClientCA, "Path to a CA bundle; clients must present a certificate it signed")
+	fs.BoolVar(&config.TLS.ClientIdentity, "tls-client-identity", config.TLS.ClientIdentity, "Use the common name of a client's certificate as its chat identity instead of a login challenge")
+
+	fs.IntVar(&config.Limits.MaxAuthFailures, "max-auth-failures", config.Limits.MaxAuthFailures, "Close a stream after this many messages that fail authentication (0 never closes)")
+	fs.DurationVar((*time.Duration)(&config.Limits.MaxClockSkew), "max-clock-skew", time.Duration(config.Limits.MaxClockSkew), "Reject messages timestamped further than this from the server clock")
+	fs.IntVar(&config.Limits.ReplayCacheSize, "replay-cache-size", config.Limits.ReplayCacheSize, "Number of recent message ids remembered for replay protection")
+	fs.IntVar(&config.Limits.SendQueueSize, "send-queue-size", config.Limits.SendQueueSize, "Number of events queued for each stream before it counts as a slow consumer")
+	fs.StringVar(&config.Limits.SlowConsumer, "slow-consumer", config.Limits.SlowConsumer, "What to do when a stream's queue is full: drop-oldest, disconnect, or block")
+	fs.DurationVar((*time.Duration)(&config.Limits.SendTimeout), "send-timeout", time.Duration(config.Limits.SendTimeout), "How long the block policy waits for room, and how long a closing stream gets to flush its queue")
+
+	fs.StringVar(&config.Storage.File, "store-file", config.Storage.File, "File to keep message history in, history is only kept in memory if empty")
+	fs.IntVar(&config.Storage.HistoryReplay, "history-replay", config.Storage.HistoryReplay, "Number of recent messages sent to a stream when it joins a channel")
+	fs.IntVar(&config.Storage.MaxBackfill, "max-backfill", config.Storage.MaxBackfill, "Most messages sent to a reconnecting stream to fill the gap since it was last connected")
+
+	fs.StringVar(&config.Logging.File, "log-file", config.Logging.File, "File to append the log to, stderr if empty")
+	fs.BoolVar(&config.Logging.UTC, "log-utc", config.Logging.UTC, "Timestamp the log in UTC")
+
+	fs.DurationVar((*time.Duration)(&config.Shutdown.Timeout), "shutdown-timeout", time.Duration(config.Shutdown.Timeout), "How long to wait for streams to finish on SIGINT or SIGTERM before stopping anyway")
+	fs.DurationVar((*time.Duration)(&config.Shutdown.ReconnectAfter), "shutdown-reconnect-after", time.Duration(config.Shutdown.ReconnectAfter), "How long clients are told to wait before reconnecting when the server shuts down, no hint if 0")
+
+	fs.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "Address to serve expvar metrics on at /debug/vars, e.g. localhost:9090, off if empty")
+	fs.Var((*stringList)(&config.ServerNames), "server-names", "Comma separated addresses clients reach the server by, as host or host:port; logins for others are refused")
+}
+
+// stringList is a flag holding a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// loadConfig works out the server's configuration from the defaults, the
+// --config file, SHITCHAT_* environment variables and the command line flags
+// in args, each overriding the ones before it.
+func loadConfig(fs *flag.FlagSet, args []string) (internal.ServerConfig, error) {
+	config := internal.DefaultServerConfig()
+	configFile := os.Getenv(envPrefix + "CONFIG")
+	fs.StringVar(&configFile, "config", configFile, "JSON config file, see docs/configuration.md")
+	bindFlags(fs, &config)
+
+	// The flags are parsed once to find the config file, and again at the
+	// end so they win over it and the environment.
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+
+	if configFile != "" {
+		if err := internal.LoadConfigFile(configFile, &config); err != nil {
+			return config, err
+		}
+	}
+	if err := internal.SetFlagsFromEnv(fs, envPrefix, onCommandLine); err != nil {
+		return config, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// setUpLogging points the log where config says.
+func setUpLogging(config internal.LoggingOptions) {
+	if config.UTC {
+		log.SetFlags(log.Flags() | log.LUTC)
+	}
+	if config.File == "" {
+		return
+	}
+	file, err := os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open log file: %v", err)
+	}
+	log.SetOutput(file)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+)
+
+// conn is a client's stream, whichever RPC it came in on. The rest of the
+// server only deals in events.
+type conn interface {
+	Context() context.Context
+	Send(*message.ServerEvent) error
+	Recv() (*message.ClientEvent, error)
+}
+
+// eventConn is a Connect stream, which speaks events already.
+type eventConn struct {
+	message.MessageService_ConnectServer
+}
+
+func (c eventConn) Send(ev *message.ServerEvent) error {
+	// Events sent to several streams are already stamped by client.send,
+	// and must not be written to while other streams are sending them.
+	if ev.Version == 0 {
+		ev.Version = internal.ProtocolVersion
+	}
+	return c.MessageService_ConnectServer.Send(ev)
+}
+
+// legacyConn adapts a Broadcast stream. Requests are either a login or a chat
+// message, and anything the server sends that a SendMessageResponse can't
+// express is dropped.
+type legacyConn struct {
+	stream message.MessageService_BroadcastServer
+}
+
+func (c legacyConn) Context() context.Context {
+	return c.stream.Context()
+}
+
+func (c legacyConn) Recv() (*message.ClientEvent, error) {
+	req, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if req.Login != nil {
+		return &message.ClientEvent{Version: internal.ProtocolVersion, Event: &message.ClientEvent_Login{Login: req.Login}}, nil
+	}
+	return &message.ClientEvent{Version: internal.ProtocolVersion, Event: &message.ClientEvent_Message{Message: req}}, nil
+}
+
+func (c legacyConn) Send(ev *message.ServerEvent) error {
+	var resp *message.SendMessageResponse
+	switch e := ev.Event.(type) {
+	case *message.ServerEvent_Challenge:
+		resp = &message.SendMessageResponse{Challenge: e.Challenge}
+	case *message.ServerEvent_Message:
+		resp = e.Message
+	case *message.ServerEvent_Error:
+		text := e.Error.Message
+		if e.Error.Id != "" {
+			text = fmt.Sprintf("message rejected: %s", e.Error.Message)
+		}
+		resp = &message.SendMessageResponse{Id: e.Error.Id, Error: e.Error.Message, Text: text}
+	case *message.ServerEvent_Notice:
+		resp = &message.SendMessageResponse{Text: e.Notice.Text}
+	case *message.ServerEvent_Shutdown:
+		resp = &message.SendMessageResponse{Text: e.Shutdown.Text}
+	default:
+		return nil
+	}
+	return c.stream.Send(resp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// handleDirectMessage relays an authenticated message to every stream of its
+// recipient, and a copy to every stream of its sender so their other devices
+// see the conversation too.
+func (s *server) handleDirectMessage(c *client, msg *message.SendMessageRequest) error {
+	if msg.Channel != "" {
+		return status.Error(codes.InvalidArgument, "a message can go to a channel or a user, not both")
+	}
+
+	stored := &internal.Message{
+		ID:        msg.Id,
+		Sender:    c.username,
+		Device:    c.device,
+		Timestamp: time.Now().UnixMilli(),
+		Recipient: msg.Recipient,
+		Body:      msg.Text,
+	}
+
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return errShuttingDown
+	}
+	recipients := s.clients[msg.Recipient]
+	if len(recipients) == 0 {
+		s.mu.Unlock()
+		return status.Errorf(codes.NotFound, "%s is not online", msg.Recipient)
+	}
+	if err := s.store.Append(stored); err != nil {
+		s.mu.Unlock()
+		log.Printf("could not store message %s: %v", msg.Id, err)
+		return status.Error(codes.Internal, "could not store message")
+	}
+	ev := messageEvent(stored, false)
+	sent := append([]*client(nil), recipients...)
+	for _, recipient := range recipients {
+		recipient.send(ev)
+	}
+	if msg.Recipient != c.username {
+		for _, sender := range s.clients[c.username] {
+			sender.send(ev)
+			sent = append(sent, sender)
+		}
+	}
+	s.mu.Unlock()
+	s.waitForRoom(sent)
+
+	c.send(&message.ServerEvent{Event: &message.ServerEvent_Ack{Ack: &message.Ack{Id: msg.Id, Timestamp: stored.Timestamp}}})
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Page sizes for History and Search when the request doesn't give one, and
+// the most it may ask for.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// messageEvent turns a stored message into the event clients are sent.
+func messageEvent(m *internal.Message, history bool) *message.ServerEvent {
+	return &message.ServerEvent{Event: &message.ServerEvent_Message{Message: messageResponse(m, history)}}
+}
+
+func messageResponse(m *internal.Message, history bool) *message.SendMessageResponse {
+	body := m.Body
+	if m.Recipient != "" {
+		body = fmt.Sprintf("(to %s) %s", m.Recipient, m.Body)
+	}
+	return &message.SendMessageResponse{
+		Id:           m.ID,
+		Sender:       m.Sender,
+		SenderDevice: m.Device,
+		Timestamp:    m.Timestamp,
+		Channel:      m.Channel,
+		Recipient:    m.Recipient,
+		Body:         m.Body,
+		Text:         legacyText(m.Sender, m.Device, body),
+		History:      history,
+		Seq:          m.Seq,
+	}
+}
+
+// sendHistory replays the last messages of channel to c.
+func (s *server) sendHistory(c *client, channel string) {
+	msgs, err := s.store.Last(channel, s.historyReplay)
+	if err != nil {
+		log.Printf("could not read history of #%s: %v", channel, err)
+		return
+	}
+	for _, m := range msgs {
+		c.send(messageEvent(m, true))
+	}
+}
+
+// sendBackfill sends c the messages in channel after seq, so a client that
+// reconnects can pick up where it left off. If there are more than
+// maxBackfill only the newest are sent and the client sees the gap.
+func (s *server) sendBackfill(c *client, channel string, seq uint64) {
+	msgs, err := s.store.After(channel, seq, s.maxBackfill)
+	if err != nil {
+		log.Printf("could not read history of #%s: %v", channel, err)
+		return
+	}
+	for _, m := range msgs {
+		c.send(messageEvent(m, true))
+	}
+}
+
+// sendDirectHistory replays the last direct messages to or from c's user.
+func (s *server) sendDirectHistory(c *client) {
+	msgs, err := s.store.LastDirect(c.username, s.historyReplay)
+	if err != nil {
+		log.Printf("could not read direct messages of %s: %v", c.username, err)
+		return
+	}
+	for _, m := range msgs {
+		c.send(messageEvent(m, true))
+	}
+}
+
+func (s *server) History(ctx context.Context, req *message.HistoryRequest) (*message.HistoryResponse, error) {
+	c := ctx.Value(sessionClient{}).(*client)
+
+	q := internal.HistoryQuery{
+		BeforeID: req.BeforeId,
+		AfterID:  req.AfterId,
+		Cursor:   req.Cursor,
+		Since:    req.Since,
+		Until:    req.Until,
+		Limit:    int(req.PageSize),
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultPageSize
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+	switch {
+	case req.User != "" && req.Channel != "":
+		return nil, status.Error(codes.InvalidArgument, "ask for a channel or a user, not both")
+	case req.User != "":
+		q.User, q.Peer = c.username, req.User
+	default:
+		q.Channel = channelOrDefault(req.Channel)
+		if !s.isMember(c, q.Channel) {
+			return nil, status.Errorf(codes.PermissionDenied, "join #%s before reading its history", q.Channel)
+		}
+	}
+
+	page, err := s.store.History(q)
+	switch {
+	case errors.Is(err, internal.ErrUnknownMessage):
+		return nil, status.Error(codes.NotFound, "no message with that id")
+	case errors.Is(err, internal.ErrInvalidCursor):
+		return nil, status.Error(codes.InvalidArgument, "invalid cursor")
+	case err != nil:
+		log.Printf("could not read history: %v", err)
+		return nil, status.Error(codes.Internal, "could not read history")
+	}
+
+	resp := &message.HistoryResponse{NextCursor: page.Next}
+	for _, m := range page.Messages {
+		resp.Messages = append(resp.Messages, messageResponse(m, true))
+	}
+	return resp, nil
+}
+
+func (s *server) Search(ctx context.Context, req *message.SearchRequest) (*message.SearchResponse, error) {
+	c := ctx.Value(sessionClient{}).(*client)
+
+	q := internal.SearchQuery{
+		Words:    internal.Tokenize(req.Query),
+		Sender:   req.Sender,
+		Channel:  req.Channel,
+		User:     c.username,
+		Channels: s.joined(c),
+		Since:    req.Since,
+		Until:    req.Until,
+		Limit:    int(req.Limit),
+	}
+	if q.Channel != "" && !q.Channels[q.Channel] {
+		return nil, status.Errorf(codes.PermissionDenied, "join #%s before searching it", q.Channel)
+	}
+	if len(q.Words) == 0 && q.Sender == "" {
+		return nil, status.Error(codes.InvalidArgument, "give some words or a sender to search for")
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultPageSize
+	}
+	if q.Limit > maxPageSize {
+		q.Limit = maxPageSize
+	}
+
+	msgs, err := s.store.Search(q)
+	if err != nil {
+		log.Printf("could not search messages: %v", err)
+		return nil, status.Error(codes.Internal, "could not search messages")
+	}
+	resp := &message.SearchResponse{}
+	for _, m := range msgs {
+		resp.Messages = append(resp.Messages, messageResponse(m, true))
+	}
+	return resp, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// Counters published on the metrics address under /debug/vars.
+var (
+	// sendFailures counts streams evicted because writing to them failed.
+	sendFailures = expvar.NewInt("send_failures")
+	// slowConsumers counts streams disconnected for not keeping up.
+	slowConsumers = expvar.NewInt("slow_consumer_disconnects")
+	// eventsDropped counts events thrown away by the drop-oldest policy.
+	eventsDropped = expvar.NewInt("events_dropped")
+)
+
+// publishMetrics adds the gauges that are read from the server's state.
+func (s *server) publishMetrics() {
+	expvar.Publish("streams", expvar.Func(func() any {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		streams := 0
+		for _, clients := range s.clients {
+			streams += len(clients)
+		}
+		return streams
+	}))
+	expvar.Publish("users_online", expvar.Func(func() any {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.clients)
+	}))
+}
+
+// serveMetrics serves expvar's /debug/vars on addr.
+func serveMetrics(addr string) {
+	log.Printf("Serving metrics on %s/debug/vars", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Printf("Metrics server stopped: %v", err)
+	}
+}
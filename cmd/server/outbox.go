@@ -0,0 +1,168 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// slowConsumerPolicy says what happens to a client whose outbox is full. The
+// names are checked by internal.ServerConfig.Validate.
+type slowConsumerPolicy string
+
+const (
+	// dropOldest throws away the oldest queued event to make room.
+	dropOldest slowConsumerPolicy = "drop-oldest"
+	// disconnectSlow ends the client's stream.
+	disconnectSlow slowConsumerPolicy = "disconnect"
+	// blockSlow queues the event anyway and holds the sender back until
+	// there is room again, ending the stream if none is made in time. The
+	// wait happens once the sender has let go of the server's lock, so only
+	// the sender waits. Joins, leaves and presence never wait; there are few
+	// of them and nobody in particular to hold back.
+	blockSlow slowConsumerPolicy = "block"
+)
+
+// errSlowConsumer ends the stream of a client that can't keep up.
+var errSlowConsumer = status.Error(codes.ResourceExhausted, "too slow to keep up with the server, disconnecting")
+
+// outbox queues the events for one client so that sending to it never waits
+// on the network. run writes them out in order.
+type outbox struct {
+	size    int
+	policy  slowConsumerPolicy
+	timeout time.Duration
+
+	mu    sync.Mutex
+	queue []*message.ServerEvent
+	// wake tells run something was queued. room is closed, and replaced,
+	// when a queue that had gone over size is back down to it.
+	wake chan struct{}
+	room chan struct{}
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// newOutbox makes an outbox holding up to size events. timeout is how long
+// close waits for the queue to be written out.
+func newOutbox(size int, policy slowConsumerPolicy, timeout time.Duration) *outbox {
+	return &outbox{
+		size:    size,
+		policy:  policy,
+		timeout: timeout,
+		wake:    make(chan struct{}, 1),
+		room:    make(chan struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// push queues ev without ever waiting. It returns errSlowConsumer if the
+// outbox is full and the policy is to give up on the client.
+func (o *outbox) push(ev *message.ServerEvent) error {
+	o.mu.Lock()
+	if len(o.queue) >= o.size {
+		switch o.policy {
+		case dropOldest:
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+			eventsDropped.Add(1)
+		case blockSlow:
+			// waitForRoom holds the sender back instead
+		default:
+			o.mu.Unlock()
+			return errSlowConsumer
+		}
+	}
+	o.queue = append(o.queue, ev)
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// waitForRoom waits until the queue is no longer over its size, which only
+// the blockSlow policy lets it go. It returns errSlowConsumer if that hasn't
+// happened by deadline.
+func (o *outbox) waitForRoom(deadline time.Time) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		o.mu.Lock()
+		full, room := len(o.queue) > o.size, o.room
+		o.mu.Unlock()
+		if !full {
+			return nil
+		}
+
+		select {
+		case <-room:
+		case <-o.closing:
+			return nil
+		case <-o.done:
+			// run gave up on the stream, so nothing is going to make room
+			return nil
+		case <-timer.C:
+			return errSlowConsumer
+		}
+	}
+}
+
+// next takes the oldest event off the queue, or returns nil if it is empty.
+func (o *outbox) next() *message.ServerEvent {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.queue) == 0 {
+		return nil
+	}
+	ev := o.queue[0]
+	o.queue[0] = nil
+	o.queue = o.queue[1:]
+	if len(o.queue) == o.size {
+		close(o.room)
+		o.room = make(chan struct{})
+	}
+	return ev
+}
+
+// run writes queued events with send until the outbox is closed and empty,
+// or send fails.
+func (o *outbox) run(send func(*message.ServerEvent) error) error {
+	defer close(o.done)
+	for {
+		if ev := o.next(); ev != nil {
+			if err := send(ev); err != nil {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-o.wake:
+		case <-o.closing:
+			// Anything queued before close is still written
+			for ev := o.next(); ev != nil; ev = o.next() {
+				if err := send(ev); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// close stops run once everything queued has been written, waiting for that
+// up to the outbox's timeout.
+func (o *outbox) close() {
+	close(o.closing)
+	select {
+	case <-o.done:
+	case <-time.After(o.timeout):
+	}
+}
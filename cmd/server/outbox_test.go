@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ngharrington/shitchat/internal"
+	"github.com/ngharrington/shitchat/message"
+)
+
+// BenchmarkFanOut measures how long a chat message takes to reach every
+// stream in a channel, from handleMessage being called until the last
+// stream's writer has sent it. The streams send instantly, so this is the
+// server's own cost of fanning out. The stuck runs add a stream that never
+// sends anything, which the others shouldn't notice.
+func BenchmarkFanOut(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 5000} {
+		for _, policy := range []slowConsumerPolicy{dropOldest, blockSlow} {
+			b.Run(fmt.Sprintf("clients=%d/%s", n, policy), func(b *testing.B) {
+				benchmarkFanOut(b, n, policy, false)
+			})
+		}
+		for _, policy := range []slowConsumerPolicy{dropOldest, disconnectSlow} {
+			b.Run(fmt.Sprintf("clients=%d/%s/stuck", n, policy), func(b *testing.B) {
+				benchmarkFanOut(b, n, policy, true)
+			})
+		}
+	}
+}
+
+func benchmarkFanOut(b *testing.B, n int, policy slowConsumerPolicy, stuck bool) {
+	s := &server{
+		clients:       make(map[string][]*client),
+		channels:      map[string]map[*client]bool{internal.DefaultChannel: {}},
+		store:         internal.NewMemoryStore(),
+		sendQueueSize: 256,
+		slowConsumer:  policy,
+		sendTimeout:   5 * time.Second,
+	}
+
+	var delivered sync.WaitGroup
+	var clients []*client
+	for i := 0; i < n; i++ {
+		c := &client{
+			username: fmt.Sprintf("user%d", i),
+			outbox:   newOutbox(s.sendQueueSize, s.slowConsumer, s.sendTimeout),
+			kick:     make(chan error, 1),
+		}
+		go c.outbox.run(func(ev *message.ServerEvent) error {
+			// The sender is acked as well, which isn't part of the fan-out
+			if ev.GetMessage() != nil {
+				delivered.Done()
+			}
+			return nil
+		})
+		s.channels[internal.DefaultChannel][c] = true
+		clients = append(clients, c)
+	}
+	if stuck {
+		c := &client{
+			username: "stuck",
+			outbox:   newOutbox(s.sendQueueSize, s.slowConsumer, 0),
+			kick:     make(chan error, 1),
+		}
+		unstuck := make(chan struct{})
+		go c.outbox.run(func(ev *message.ServerEvent) error {
+			<-unstuck
+			return nil
+		})
+		s.channels[internal.DefaultChannel][c] = true
+		defer close(unstuck)
+		clients = append(clients, c)
+	}
+	defer func() {
+		for _, c := range clients {
+			c.outbox.close()
+		}
+	}()
+
+	sender := clients[0]
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		delivered.Add(n)
+		msg := &message.SendMessageRequest{Id: fmt.Sprint(i), Text: "hello"}
+		if err := s.handleMessage(sender, msg); err != nil {
+			b.Fatal(err)
+		}
+		delivered.Wait()
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*n), "ns/client")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/ngharrington/shitchat/message"
+)
+
+// announcePresence tells every open stream that username came online or went
+// offline. s.mu must be held.
+func (s *server) announcePresence(username string, online bool) {
+	ev := &message.ServerEvent{Event: &message.ServerEvent_Presence{Presence: &message.PresenceEvent{
+		Username: username,
+		Online:   online,
+	}}}
+	for _, clients := range s.clients {
+		for _, client := range clients {
+			client.send(ev)
+		}
+	}
+}
+
+func (s *server) Who(ctx context.Context, req *message.WhoRequest) (*message.WhoResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &message.WhoResponse{}
+	for username, clients := range s.clients {
+		devices := make(map[string]bool)
+		for _, client := range clients {
+			if req.Channel == "" || s.channels[req.Channel][client] {
+				devices[client.device] = true
+			}
+		}
+		if len(devices) == 0 {
+			continue
+		}
+		user := &message.User{Username: username}
+		for device := range devices {
+			user.Devices = append(user.Devices, device)
+		}
+		sort.Strings(user.Devices)
+		resp.Users = append(resp.Users, user)
+	}
+	sort.Slice(resp.Users, func(i, j int) bool { return resp.Users[i].Username < resp.Users[j].Username })
+	return resp, nil
+}
@@ -1,69 +1,528 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ngharrington/shitchat/internal"
 	"github.com/ngharrington/shitchat/message"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
 	message.UnimplementedMessageServiceServer
 
-	clients       map[string]message.MessageService_BroadcastServer
-	clientID      int
+	// clients holds every open stream, keyed by the username it logged in as.
+	// Streams are added once they have been welcomed.
+	clients map[string][]*client
+	// channels holds the streams that have joined each channel.
+	channels map[string]map[*client]bool
+	// sessions maps session tokens to the stream that was given them.
+	sessions      map[string]*client
 	mu            sync.Mutex
 	authenticator internal.Authenticator
+
+	// maxAuthFailures is how many messages that fail authentication a stream
+	// may send before it is closed. Zero keeps the stream open no matter what.
+	maxAuthFailures int
+
+	// Messages timestamped further than maxClockSkew from the server's clock
+	// are rejected, and replays catches ids that have already been used.
+	maxClockSkew time.Duration
+	replays      *internal.ReplayCache
+
+	// certIdentity logs streams in as the common name of their verified
+	// client certificate, skipping the challenge.
+	certIdentity bool
+	// serverNames are the addresses logins may be for, any if empty.
+	serverNames []string
+
+	// store keeps every accepted message. The last historyReplay messages of
+	// a channel are sent to each stream that joins it.
+	store         internal.MessageStore
+	historyReplay int
+	// maxBackfill is the most messages sent to a stream resuming a channel.
+	maxBackfill int
+
+	// Each stream queues up to sendQueueSize events, and slowConsumer says
+	// what happens once it is full. sendTimeout bounds how long a full queue
+	// is waited on.
+	sendQueueSize int
+	slowConsumer  slowConsumerPolicy
+	sendTimeout   time.Duration
+
+	// draining is set once the server starts shutting down, and turns away
+	// new streams. Messages aren't stored once it is set, so the store can
+	// be closed while handlers are still running.
+	draining bool
+}
+
+// client is a logged in stream.
+type client struct {
+	username string
+	// key is the key the stream logged in with, or nil if it was identified
+	// by its certificate.
+	key     *internal.Key
+	device  string
+	session string
+
+	conn   conn
+	outbox *outbox
+
+	// kick ends the stream with the error sent on it.
+	kick chan error
+}
+
+// send queues ev for the client's stream without waiting for it to be
+// written. Clients that can't keep up may be disconnected.
+func (c *client) send(ev *message.ServerEvent) error {
+	// The same event is often queued for many streams, whose outboxes
+	// send it at the same time, so it is stamped before any of them has it.
+	if ev.Version == 0 {
+		ev.Version = internal.ProtocolVersion
+	}
+	err := c.outbox.push(ev)
+	if err == errSlowConsumer {
+		c.disconnect(err)
+	}
+	return err
+}
+
+// waitForRoom holds the caller back until none of clients has more queued
+// than its outbox is meant to hold, for the block policy. It is called after
+// sending to them and letting go of s.mu, so a stuck client only holds up
+// whoever is sending to it. Clients still over after sendTimeout are
+// disconnected.
+func (s *server) waitForRoom(clients []*client) {
+	if s.slowConsumer != blockSlow {
+		return
+	}
+	deadline := time.Now().Add(s.sendTimeout)
+	for _, c := range clients {
+		if err := c.outbox.waitForRoom(deadline); err != nil {
+			c.disconnect(err)
+		}
+	}
+}
+
+// sendError tells the client the server refused to do something.
+func (c *client) sendError(id string, err error) error {
+	st := status.Convert(err)
+	return c.send(&message.ServerEvent{Event: &message.ServerEvent_Error{Error: &message.ErrorEvent{
+		Code:    uint32(st.Code()),
+		Message: st.Message(),
+		Id:      id,
+	}}})
+}
+
+// disconnect ends the client's stream with err. It never blocks; only the
+// first reason given is used.
+func (c *client) disconnect(err error) {
+	select {
+	case c.kick <- err:
+	default:
+	}
 }
 
 func (s *server) Broadcast(stream message.MessageService_BroadcastServer) error {
+	return s.serve(legacyConn{stream})
+}
+
+func (s *server) Connect(stream message.MessageService_ConnectServer) error {
+	return s.serve(eventConn{stream})
+}
+
+// serve logs a stream in and handles its events until it ends.
+func (s *server) serve(conn conn) error {
+	if s.isDraining() {
+		return errShuttingDown
+	}
+	c, err := s.login(conn)
+	if err != nil {
+		log.Printf("login failed: %v", err)
+		return err
+	}
+	c.conn = conn
+	c.kick = make(chan error, 1)
+	// Only the outbox writes to the stream from here on, as gRPC streams
+	// can't be written to from two goroutines at once.
+	c.outbox = newOutbox(s.sendQueueSize, s.slowConsumer, s.sendTimeout)
+	go func() {
+		// A stream that can't be written to is gone, even if its Recv
+		// hasn't noticed yet.
+		if err := c.outbox.run(conn.Send); err != nil {
+			sendFailures.Add(1)
+			c.disconnect(status.Errorf(codes.Unavailable, "could not send to the stream: %v", status.Convert(err).Message()))
+		}
+	}()
+	defer c.outbox.close()
+	defer s.removeClient(c)
+
+	session, err := s.newSession(c)
+	if err != nil {
+		return err
+	}
+	// Welcome and register the stream under one lock, so nothing broadcast
+	// reaches it before the Welcome and anything asking who is online once
+	// it has the Welcome sees it.
 	s.mu.Lock()
-	s.clientID++
-	clientID := fmt.Sprintf("Client %d", s.clientID)
-	s.clients[clientID] = stream
+	if s.draining {
+		// The server started shutting down during the login
+		s.mu.Unlock()
+		return errShuttingDown
+	}
+	err = c.send(&message.ServerEvent{Event: &message.ServerEvent_Welcome{Welcome: &message.Welcome{Username: c.username, Device: c.device, Session: session, Epoch: s.store.Epoch()}}})
+	if err == nil {
+		if len(s.clients[c.username]) == 0 {
+			s.announcePresence(c.username, true)
+		}
+		s.clients[c.username] = append(s.clients[c.username], c)
+	}
 	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Every stream starts out in the default channel, plus whatever it was
+	// in before if it is reconnecting.
+	resume := resumePoints(conn.Context(), s.store.Epoch())
+	if err := s.join(c, internal.DefaultChannel, resume[internal.DefaultChannel]); err != nil {
+		return err
+	}
+	for channel, seq := range resume {
+		if channel == internal.DefaultChannel {
+			continue
+		}
+		if err := s.join(c, channel, seq); err != nil {
+			c.sendError("", err)
+		}
+	}
+	s.sendDirectHistory(c)
+
+	// Recv blocks, so it gets its own goroutine and the loop below can
+	// notice a kick straight away.
+	events := make(chan *message.ClientEvent)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			ev, err := conn.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case events <- ev:
+			case <-conn.Context().Done():
+				return
+			}
+		}
+	}()
 
+	failures := 0
 	for {
-		// TODO: this error handling seems like it is meant to handle the initial connection
-		// not sure maybe better handling on the other loops?
-		msg, err := stream.Recv()
-		if err != nil {
-			s.mu.Lock()
-			delete(s.clients, clientID)
-			s.mu.Unlock()
+		var ev *message.ClientEvent
+		select {
+		case err := <-c.kick:
+			log.Printf("disconnecting %s: %v", c.username, err)
+			if err == errSlowConsumer {
+				slowConsumers.Add(1)
+			}
+			return err
+		case err := <-recvErr:
 			return err
+		case ev = <-events:
 		}
-		data := []byte(msg.Text)
-		auth, err := s.authenticator.Authenticate(msg.Username, msg.Signature, data)
-		if err != nil || !auth {
-			fmt.Println(err)
-			log.Println("error authenticating user")
+
+		if ev.Version != internal.ProtocolVersion {
+			return status.Errorf(codes.FailedPrecondition, "unsupported protocol version %d, the server speaks %d", ev.Version, internal.ProtocolVersion)
 		}
 
-		s.mu.Lock()
-		for _, client := range s.clients {
-			client.Send(&message.SendMessageResponse{Text: fmt.Sprintf("%s: %s", msg.Username, msg.GetText())})
+		switch e := ev.Event.(type) {
+		case *message.ClientEvent_Message:
+			// Clients resend messages whose ack was lost under the same
+			// id, so one that is already stored is only acked again. The
+			// stream is logged in as the sender, so nobody else can.
+			if stored := s.resent(c, e.Message.Id); stored != nil {
+				c.send(&message.ServerEvent{Event: &message.ServerEvent_Ack{Ack: &message.Ack{Id: stored.ID, Timestamp: stored.Timestamp}}})
+				break
+			}
+			err := s.authenticate(c, e.Message)
+			authFailed := err != nil
+			if err == nil {
+				err = s.handleMessage(c, e.Message)
+			}
+			if err != nil {
+				log.Printf("rejected message %s from %s: %v", e.Message.Id, c.username, err)
+
+				// Let the sender know why nothing showed up
+				c.sendError(e.Message.Id, err)
+			}
+
+			// Only forged or replayed messages count, not ones sent to a
+			// user who is offline or a channel the sender isn't in.
+			if authFailed {
+				failures++
+				if s.maxAuthFailures > 0 && failures >= s.maxAuthFailures {
+					return err
+				}
+			}
+		case *message.ClientEvent_Typing:
+			channel := channelOrDefault(e.Typing.Channel)
+			if !s.isMember(c, channel) {
+				c.sendError("", status.Errorf(codes.PermissionDenied, "join #%s before typing in it", channel))
+				break
+			}
+			s.broadcast(channel, &message.ServerEvent{Event: &message.ServerEvent_Typing{Typing: &message.TypingEvent{
+				Channel:  channel,
+				Username: c.username,
+			}}}, c)
+		case *message.ClientEvent_Join:
+			if err := s.join(c, e.Join.Channel, 0); err != nil {
+				c.sendError("", err)
+			}
+		case *message.ClientEvent_Leave:
+			if err := s.leave(c, e.Leave.Channel); err != nil {
+				c.sendError("", err)
+			}
+		case *message.ClientEvent_Login:
+			c.sendError("", status.Error(codes.FailedPrecondition, "already logged in"))
+		default:
+			c.sendError("", status.Errorf(codes.Unimplemented, "the server does not handle %T events", ev.Event))
 		}
+	}
+}
+
+// resent returns the message c's user already sent with id, or nil.
+func (s *server) resent(c *client, id string) *internal.Message {
+	if id == "" {
+		return nil
+	}
+	stored, err := s.store.Sent(c.username, id)
+	if err != nil {
+		log.Printf("could not look up message %s: %v", id, err)
+		return nil
+	}
+	return stored
+}
+
+// handleMessage relays a chat message from c that has been authenticated. It
+// returns a gRPC status error if the message was rejected.
+func (s *server) handleMessage(c *client, msg *message.SendMessageRequest) error {
+	if msg.Recipient != "" {
+		return s.handleDirectMessage(c, msg)
+	}
+	// The signature covers the channel as the client sent it, so it is only
+	// filled in now.
+	channel := channelOrDefault(msg.Channel)
+	if !s.isMember(c, channel) {
+		return status.Errorf(codes.PermissionDenied, "join #%s before sending to it", channel)
+	}
+
+	stored := &internal.Message{
+		ID:        msg.Id,
+		Sender:    c.username,
+		Device:    c.device,
+		Timestamp: time.Now().UnixMilli(),
+		Channel:   channel,
+		Body:      msg.Text,
+	}
+
+	// Store and send under the same lock so a stream joining at the same
+	// time either gets the message replayed or sent, never both.
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return errShuttingDown
+	}
+	if err := s.store.Append(stored); err != nil {
 		s.mu.Unlock()
+		log.Printf("could not store message %s: %v", msg.Id, err)
+		return status.Error(codes.Internal, "could not store message")
+	}
+	ev := messageEvent(stored, false)
+	members := make([]*client, 0, len(s.channels[channel]))
+	for member := range s.channels[channel] {
+		member.send(ev)
+		members = append(members, member)
+	}
+	s.mu.Unlock()
+	s.waitForRoom(members)
+
+	c.send(&message.ServerEvent{Event: &message.ServerEvent_Ack{Ack: &message.Ack{Id: msg.Id, Timestamp: stored.Timestamp}}})
+	return nil
+}
+
+// broadcast sends ev to every member of channel except skip, which may be
+// nil.
+func (s *server) broadcast(channel string, ev *message.ServerEvent, skip *client) {
+	s.mu.Lock()
+	var sent []*client
+	for client := range s.channels[channel] {
+		if client != skip {
+			client.send(ev)
+			sent = append(sent, client)
+		}
+	}
+	s.mu.Unlock()
+	s.waitForRoom(sent)
+}
+
+// legacyText formats a message the way the server did before responses had
+// separate fields, for older clients that only read SendMessageResponse.Text.
+func legacyText(username, device, body string) string {
+	sender := username
+	if device != internal.DefaultLabel {
+		sender = fmt.Sprintf("%s (%s)", username, device)
+	}
+	return fmt.Sprintf("%s: %s", sender, body)
+}
+
+// removeClient forgets a stream that has ended, telling the channels it was
+// in that it left and everyone else if its user is now offline.
+func (s *server) removeClient(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for channel, members := range s.channels {
+		if !members[c] {
+			continue
+		}
+		s.removeMember(c, channel)
+		ev := &message.ServerEvent{Event: &message.ServerEvent_Leave{Leave: &message.LeaveEvent{Channel: channel, Username: c.username}}}
+		for member := range members {
+			member.send(ev)
+		}
+	}
+	delete(s.sessions, c.session)
+
+	clients := s.clients[c.username]
+	for i, other := range clients {
+		if other == c {
+			clients = append(clients[:i], clients[i+1:]...)
+			if len(clients) == 0 {
+				delete(s.clients, c.username)
+				s.announcePresence(c.username, false)
+			} else {
+				s.clients[c.username] = clients
+			}
+			break
+		}
+	}
+}
+
+// reloadOnHangup reloads the key directory whenever the process gets SIGHUP.
+func reloadOnHangup(auth *internal.InMemoryAuthenticator) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Println("SIGHUP received, reloading keys")
+		if err := auth.Reload(); err != nil {
+			log.Printf("Keeping previous keys: %v", err)
+		}
 	}
 }
 
 func main() {
-	lis, err := net.Listen("tcp", ":50051")
+	config, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	setUpLogging(config.Logging)
+
+	lis, err := net.Listen("tcp", config.Listen)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	auth := internal.NewInMemoryAuthenticator("/home/neal/workspace/shitchat/scratch/keys/")
-	message.RegisterMessageServiceServer(s, &server{clients: make(map[string]message.MessageService_BroadcastServer), authenticator: auth})
+	var opts []grpc.ServerOption
+	if config.TLS.Cert != "" {
+		tlsConfig, err := internal.ServerTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	auth, err := internal.NewInMemoryAuthenticator(config.PublicKeyPath)
+	if err != nil {
+		log.Fatalf("Failed to load keys: %v", err)
+	}
+	var store internal.MessageStore = internal.NewMemoryStore()
+	if config.Storage.File != "" {
+		if store, err = internal.OpenFileStore(config.Storage.File); err != nil {
+			log.Fatalf("Failed to open message store: %v", err)
+		}
+	}
+
+	srv := &server{
+		clients:         make(map[string][]*client),
+		channels:        make(map[string]map[*client]bool),
+		sessions:        make(map[string]*client),
+		authenticator:   auth,
+		maxAuthFailures: config.Limits.MaxAuthFailures,
+		maxClockSkew:    time.Duration(config.Limits.MaxClockSkew),
+		replays:         internal.NewReplayCache(config.Limits.ReplayCacheSize, time.Duration(config.Limits.MaxClockSkew)),
+		certIdentity:    config.TLS.ClientIdentity,
+		serverNames:     config.ServerNames,
+		store:           store,
+		historyReplay:   config.Storage.HistoryReplay,
+		maxBackfill:     config.Storage.MaxBackfill,
+		sendQueueSize:   config.Limits.SendQueueSize,
+		slowConsumer:    slowConsumerPolicy(config.Limits.SlowConsumer),
+		sendTimeout:     time.Duration(config.Limits.SendTimeout),
+	}
+	opts = append(opts, grpc.UnaryInterceptor(srv.sessionInterceptor))
+	// The CLI pings every 30 seconds to notice dead connections, more often
+	// than gRPC allows by default. The server pings quiet clients too, so
+	// ones that vanished without closing their connection are evicted.
+	opts = append(opts,
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 20 * time.Second}),
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: time.Minute, Timeout: 20 * time.Second}),
+	)
+	s := grpc.NewServer(opts...)
+	message.RegisterMessageServiceServer(s, srv)
+
+	// Revoked keys are kicked as soon as the directory is reloaded, expired
+	// ones on the next tick.
+	auth.OnReload = srv.checkKeys
+	go reloadOnHangup(auth)
+	if config.KeyReloadInterval > 0 {
+		go auth.Watch(time.Duration(config.KeyReloadInterval), nil)
+	}
+	go func() {
+		for range time.Tick(time.Duration(config.KeyCheckInterval)) {
+			srv.checkKeys()
+		}
+	}()
 
-	log.Println("Server is running on port 50051")
+	srv.publishMetrics()
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr)
+	}
+
+	stopped := make(chan struct{})
+	go stopOnSignal(srv, s, time.Duration(config.Shutdown.ReconnectAfter), time.Duration(config.Shutdown.Timeout), stopped)
+
+	log.Printf("Server is running on %s", config.Listen)
 	if err := s.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
+	// Serve returns as soon as the listener closes, before the streams have
+	// finished. Handlers that are still running after a forced stop don't
+	// touch the store once the server is draining.
+	<-stopped
+	if err := store.Close(); err != nil {
+		log.Fatalf("Failed to close message store: %v", err)
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ngharrington/shitchat/message"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errShuttingDown ends every stream when the server shuts down, and turns
+// away new ones while it does.
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
+// drain stops the server taking new streams and ends the open ones, warning
+// them first. reconnectAfter is passed on as a hint if it isn't zero.
+func (s *server) drain(reconnectAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+
+	text := "server is shutting down"
+	if reconnectAfter > 0 {
+		text = fmt.Sprintf("server is shutting down, try reconnecting in %s", reconnectAfter)
+	}
+	ev := &message.ServerEvent{Event: &message.ServerEvent_Shutdown{Shutdown: &message.ShutdownNotice{
+		Text:           text,
+		ReconnectAfter: reconnectAfter.Milliseconds(),
+	}}}
+	for _, clients := range s.clients {
+		for _, client := range clients {
+			// The outbox is flushed before the stream ends, so the notice
+			// still gets there.
+			client.send(ev)
+			client.disconnect(errShuttingDown)
+		}
+	}
+}
+
+// isDraining reports whether the server is shutting down.
+func (s *server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// stopOnSignal shuts the server down gracefully on SIGINT or SIGTERM: open
+// streams are drained, then gs stops once every RPC has finished or timeout
+// has passed, whichever is first. stopped is closed once it has.
+func stopOnSignal(srv *server, gs *grpc.Server, reconnectAfter, timeout time.Duration, stopped chan<- struct{}) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("%s received, shutting down", <-sig)
+
+	srv.drain(reconnectAfter)
+	timer := time.AfterFunc(timeout, func() {
+		log.Printf("Still busy after %s, stopping anyway", timeout)
+		gs.Stop()
+	})
+	gs.GracefulStop()
+	timer.Stop()
+	close(stopped)
+}
@@ -1,99 +1,238 @@
 package internal
 
 import (
-	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	// ErrUnknownUser is returned when no key is registered for a username.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrKeyRevoked is returned for keys on the revocation list.
+	ErrKeyRevoked = errors.New("key has been revoked")
+	// ErrKeyExpired is returned for keys past their not-after date.
+	ErrKeyExpired = errors.New("key has expired")
+	// ErrKeyNotYetValid is returned for keys before their not-before date.
+	ErrKeyNotYetValid = errors.New("key is not valid yet")
+)
+
+// loginContext is mixed into login signatures so that a signed challenge can
+// never be passed off as a signed chat message, or the other way around.
+const loginContext = "shitchat login v2\x00"
+
+// LoginPayload returns the bytes a client signs to answer a login challenge.
+// server is the address the client dialed and binding the ChannelBinding of
+// its connection, nil without TLS. They tie the answer to the server the
+// client meant to reach, so a server reached by mistake can't relay another
+// server's challenge and log in there with the answer.
+func LoginPayload(nonce []byte, server string, binding []byte) []byte {
+	buf := []byte(loginContext)
+	for _, field := range [][]byte{nonce, []byte(server), binding} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// messageContext plays the same role as loginContext for chat messages.
+const messageContext = "shitchat message v1\x00"
+
+// MessagePayload returns the canonical encoding of a chat message that a
+// client signs. Every field is covered so a signature can't be lifted onto a
+// different id, sender, time or channel.
+func MessagePayload(id, username string, timestamp int64, channel, text string) []byte {
+	return payload(messageContext, id, username, timestamp, channel, text)
+}
+
+// directMessageContext keeps a direct message's signature from being passed
+// off as one for a channel of the same name as the recipient.
+const directMessageContext = "shitchat direct message v1\x00"
+
+// DirectMessagePayload is MessagePayload for a message to a single user.
+func DirectMessagePayload(id, username string, timestamp int64, recipient, text string) []byte {
+	return payload(directMessageContext, id, username, timestamp, recipient, text)
+}
+
+func payload(context, id, username string, timestamp int64, to, text string) []byte {
+	buf := []byte(context)
+	for _, field := range []string{id, username, to, text} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return binary.BigEndian.AppendUint64(buf, uint64(timestamp))
+}
+
 type Authenticator interface {
-	Authenticate(username, signature string, msg []byte) (bool, error)
+	// Authenticate verifies that signature is username's signature over msg
+	// and returns the key that made it.
+	Authenticate(username, signature string, msg []byte) (*Key, error)
+	// Check returns an error if key has since been removed, revoked or has
+	// fallen outside the dates it is valid for.
+	Check(key *Key) error
 }
 
 type InMemoryAuthenticator struct {
-	users map[string]*rsa.PublicKey
+	dir string
+
+	// OnReload, if set, is called after every successful Reload so callers
+	// can drop anything that was using a key that has gone away.
+	OnReload func()
+
+	mu   sync.RWMutex
+	keys *keySet
 }
 
-func NewInMemoryAuthenticator(authDir string) *InMemoryAuthenticator {
-	// Here we hardcode users and their keys
-	users, err := readUsersFromDir(authDir)
+func NewInMemoryAuthenticator(authDir string) (*InMemoryAuthenticator, error) {
+	keys, err := readKeyDir(authDir)
 	if err != nil {
-		fmt.Println(err)
-		log.Panicln("Error creating in memory authenticator")
+		return nil, fmt.Errorf("reading keys from %s: %w", authDir, err)
 	}
-	return &InMemoryAuthenticator{users: users}
+	return &InMemoryAuthenticator{dir: authDir, keys: keys}, nil
 }
 
-func (a *InMemoryAuthenticator) Authenticate(username, signature string, msg []byte) (bool, error) {
-	pubKey, ok := a.users[username]
-	if !ok {
-		return false, errors.New("unknown user")
+// Reload reads the key directory again and swaps in the new set of users. If
+// anything in the directory can't be read the current users are kept.
+func (a *InMemoryAuthenticator) Reload() error {
+	keys, err := readKeyDir(a.dir)
+	if err != nil {
+		return fmt.Errorf("reading keys from %s: %w", a.dir, err)
 	}
 
-	// Generate a cryptographic hash of the message
-	hash := sha256.New()
-	hash.Write(msg)
-	hashedMsg := hash.Sum(nil)
+	a.mu.Lock()
+	old := a.keys
+	a.keys = keys
+	a.mu.Unlock()
 
-	// Convert the signature from a string back to a byte slice for verification
-	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
-	if err != nil {
-		return false, err // Handle this error properly
+	for username, userKeys := range keys.users {
+		if _, ok := old.users[username]; !ok {
+			log.Printf("added user %s", username)
+		}
+		for _, key := range userKeys {
+			oldKey := old.find(username, key.Fingerprint)
+			if oldKey == nil {
+				log.Printf("added key %s (%s) for user %s", key.Label, key.Fingerprint, username)
+			}
+			if keys.isRevoked(key) && (oldKey == nil || !old.isRevoked(oldKey)) {
+				log.Printf("revoked key %s (%s) for user %s", key.Label, key.Fingerprint, username)
+			}
+		}
+	}
+	for username, userKeys := range old.users {
+		if _, ok := keys.users[username]; !ok {
+			log.Printf("removed user %s", username)
+			continue
+		}
+		for _, key := range userKeys {
+			if keys.find(username, key.Fingerprint) == nil {
+				log.Printf("removed key %s (%s) for user %s", key.Label, key.Fingerprint, username)
+			}
+		}
 	}
 
-	// Verify the signature
-	err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashedMsg, signatureBytes)
-	if err != nil {
-		fmt.Println("username:", username)
-		fmt.Println("hashed message:", hashedMsg)
-		fmt.Println("decoded signature:", signatureBytes)
-		return false, nil // The authentication failed, but this is not an 'error' per se
+	if a.OnReload != nil {
+		a.OnReload()
 	}
+	return nil
+}
+
+// Watch polls the key directory every interval and reloads it when a file is
+// added, removed or modified, until stop is closed.
+func (a *InMemoryAuthenticator) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := dirSnapshot(a.dir)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		snapshot, err := dirSnapshot(a.dir)
+		if err != nil {
+			log.Printf("Could not read key directory: %v", err)
+			continue
+		}
+		if snapshot == last {
+			continue
+		}
+		last = snapshot
 
-	return true, nil
+		if err := a.Reload(); err != nil {
+			log.Printf("Keeping previous keys: %v", err)
+		}
+	}
 }
 
-func readUsersFromDir(dir string) (map[string]*rsa.PublicKey, error) {
-	users := make(map[string]*rsa.PublicKey)
+// dirSnapshot summarises the names, sizes and modification times of the
+// files under dir so Watch can tell when something changed.
+func dirSnapshot(dir string) (string, error) {
+	var b strings.Builder
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return b.String(), err
+}
 
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, err
+// Authenticate accepts a signature from any of username's keys.
+func (a *InMemoryAuthenticator) Authenticate(username, signature string, msg []byte) (*Key, error) {
+	a.mu.RLock()
+	userKeys, ok := a.keys.users[username]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownUser
 	}
 
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".pub" {
-			content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
-			if err != nil {
-				return nil, err
-			}
+	// Convert the signature from a string back to a byte slice for verification
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
 
-			block, _ := pem.Decode(content)
-			if block == nil || block.Type != "PUBLIC KEY" {
-				log.Printf("Could not decode %s", file.Name())
-				continue
-			}
+	// Verify the signature
+	var key *Key
+	for _, candidate := range userKeys {
+		if Verify(candidate.PublicKey, msg, signatureBytes) == nil {
+			key = candidate
+			break
+		}
+	}
+	if key == nil {
+		return nil, ErrInvalidSignature
+	}
 
-			publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-			if err != nil {
-				return nil, err
-			}
+	// Only complain about revocation and expiry for a valid signature, so
+	// nobody can probe for the state of someone else's key.
+	if err := a.Check(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
 
-			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
-			if !ok {
-				return nil, errors.New("invalid RSA public key")
-			}
+func (a *InMemoryAuthenticator) Check(key *Key) error {
+	a.mu.RLock()
+	keys := a.keys
+	a.mu.RUnlock()
 
-			users[file.Name()[:len(file.Name())-4]] = rsaPublicKey
-		}
+	current := keys.find(key.Username, key.Fingerprint)
+	if current == nil {
+		return ErrUnknownUser
+	}
+	if keys.isRevoked(current) {
+		return ErrKeyRevoked
 	}
-	return users, nil
+	return current.validAt(time.Now())
 }
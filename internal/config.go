@@ -1,5 +1,301 @@
 package internal
 
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServerConfig is everything the server can be configured with. It starts
+// out as DefaultServerConfig, and is then overridden by a JSON config file,
+// SHITCHAT_* environment variables and command line flags, in that order.
 type ServerConfig struct {
-	PublicKeyPath string
+	// Listen is the address the server serves on.
+	Listen string `json:"listen"`
+	// PublicKeyPath is the key directory, holding the public keys users log
+	// in with.
+	PublicKeyPath string `json:"public_key_path"`
+	// KeyReloadInterval is how often the key directory is checked for
+	// changes, zero only reloads it on SIGHUP. KeyCheckInterval is how often
+	// streams whose keys have expired are disconnected.
+	KeyReloadInterval Duration `json:"key_reload_interval"`
+	KeyCheckInterval  Duration `json:"key_check_interval"`
+
+	TLS      TLSOptions      `json:"tls"`
+	Limits   LimitOptions    `json:"limits"`
+	Storage  StorageOptions  `json:"storage"`
+	Logging  LoggingOptions  `json:"logging"`
+	Shutdown ShutdownOptions `json:"shutdown"`
+
+	// MetricsAddr is where expvar metrics are served, off if empty.
+	MetricsAddr string `json:"metrics_addr"`
+
+	// ServerNames are the addresses clients reach the server by, as host or
+	// host:port. Logins for any other address are refused. Without TLS this
+	// is all that stops another server relaying logins to this one.
+	ServerNames []string `json:"server_names"`
+}
+
+// TLSOptions turn on TLS, which is off unless Cert is set.
+type TLSOptions struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ClientCA makes clients present a certificate it signed.
+	ClientCA string `json:"client_ca"`
+	// ClientIdentity logs clients in as the common name of their
+	// certificate instead of sending a login challenge.
+	ClientIdentity bool `json:"client_identity"`
+}
+
+// LimitOptions protect the server from misbehaving and slow clients.
+type LimitOptions struct {
+	MaxAuthFailures int      `json:"max_auth_failures"`
+	MaxClockSkew    Duration `json:"max_clock_skew"`
+	ReplayCacheSize int      `json:"replay_cache_size"`
+	SendQueueSize   int      `json:"send_queue_size"`
+	// SlowConsumer is drop-oldest, disconnect or block.
+	SlowConsumer string   `json:"slow_consumer"`
+	SendTimeout  Duration `json:"send_timeout"`
+}
+
+// StorageOptions say where messages are kept and how much history is sent to
+// clients without them asking.
+type StorageOptions struct {
+	// File is the message store, messages are only kept in memory if it is
+	// empty.
+	File          string `json:"file"`
+	HistoryReplay int    `json:"history_replay"`
+	MaxBackfill   int    `json:"max_backfill"`
+}
+
+// LoggingOptions say where the server's log goes.
+type LoggingOptions struct {
+	// File is appended to, the log goes to stderr if it is empty.
+	File string `json:"file"`
+	// UTC timestamps log lines in UTC instead of local time.
+	UTC bool `json:"utc"`
+}
+
+// ShutdownOptions control what happens on SIGINT and SIGTERM.
+type ShutdownOptions struct {
+	Timeout        Duration `json:"timeout"`
+	ReconnectAfter Duration `json:"reconnect_after"`
+}
+
+// DefaultServerConfig returns the configuration the server uses when nothing
+// else is set.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Listen:            ":50051",
+		PublicKeyPath:     "scratch/keys",
+		KeyReloadInterval: Duration(10 * time.Second),
+		KeyCheckInterval:  Duration(5 * time.Second),
+		Limits: LimitOptions{
+			MaxAuthFailures: 3,
+			MaxClockSkew:    Duration(2 * time.Minute),
+			ReplayCacheSize: 100000,
+			SendQueueSize:   256,
+			SlowConsumer:    "drop-oldest",
+			SendTimeout:     Duration(5 * time.Second),
+		},
+		Storage: StorageOptions{
+			File:          "messages.jsonl",
+			HistoryReplay: 50,
+			MaxBackfill:   1000,
+		},
+		Shutdown: ShutdownOptions{
+			Timeout: Duration(10 * time.Second),
+		},
+	}
+}
+
+// LoadConfigFile reads the JSON file at path into config. Only the fields in
+// the file are changed, and fields config doesn't have are an error so typos
+// don't go unnoticed.
+func LoadConfigFile(path string, config interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// SetFlagsFromEnv sets every flag in fs that isn't in skip from its
+// environment variable, if there is one. The variable is the flag's name in
+// upper case with dashes turned into underscores, after prefix, so with the
+// prefix "SHITCHAT_" --tls-cert is read from SHITCHAT_TLS_CERT.
+func SetFlagsFromEnv(fs *flag.FlagSet, prefix string, skip map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || skip[f.Name] {
+			return
+		}
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %w", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// ConfigError lists everything wrong with a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// Validate checks that the configuration makes sense, returning a
+// *ConfigError with every problem it finds.
+func (c *ServerConfig) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" {
+		problem("listen address is empty")
+	}
+	if c.PublicKeyPath == "" {
+		problem("public_key_path is empty")
+	} else if info, err := os.Stat(c.PublicKeyPath); err != nil {
+		problem("key directory: %v", err)
+	} else if !info.IsDir() {
+		problem("key directory %s is not a directory", c.PublicKeyPath)
+	}
+	if c.KeyReloadInterval < 0 || c.KeyCheckInterval <= 0 {
+		problem("key_reload_interval can't be negative and key_check_interval must be positive")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		problem("tls.cert and tls.key go together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		problem("client certificates need tls.cert and tls.key")
+	}
+	if c.TLS.ClientIdentity && c.TLS.ClientCA == "" {
+		problem("tls.client_identity needs tls.client_ca")
+	}
+
+	if c.Limits.MaxAuthFailures < 0 {
+		problem("limits.max_auth_failures can't be negative")
+	}
+	if c.Limits.MaxClockSkew <= 0 {
+		problem("limits.max_clock_skew must be positive")
+	}
+	if c.Limits.ReplayCacheSize < 1 {
+		problem("limits.replay_cache_size must be at least 1")
+	}
+	if c.Limits.SendQueueSize < 1 {
+		problem("limits.send_queue_size must be at least 1")
+	}
+	switch c.Limits.SlowConsumer {
+	case "drop-oldest", "disconnect", "block":
+	default:
+		problem("limits.slow_consumer %q is not drop-oldest, disconnect or block", c.Limits.SlowConsumer)
+	}
+	if c.Limits.SendTimeout <= 0 {
+		problem("limits.send_timeout must be positive")
+	}
+
+	if c.Storage.HistoryReplay < 0 || c.Storage.MaxBackfill < 0 {
+		problem("storage.history_replay and storage.max_backfill can't be negative")
+	}
+	if c.Shutdown.Timeout <= 0 {
+		problem("shutdown.timeout must be positive")
+	}
+	if c.Shutdown.ReconnectAfter < 0 {
+		problem("shutdown.reconnect_after can't be negative")
+	}
+
+	if problems != nil {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Duration is a time.Duration written like "10s" in config files.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are strings like \"10s\", not %s", data)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ClientConfig is the CLI's config file, a set of named profiles for the
+// servers it connects to.
+type ClientConfig struct {
+	// DefaultProfile is used when no profile is asked for.
+	DefaultProfile string             `json:"default_profile"`
+	Profiles       map[string]Profile `json:"profiles"`
+}
+
+// Profile is how the CLI connects to one server. Empty fields are left to
+// the CLI's flags and defaults.
+type Profile struct {
+	// Server is the server's address, as host:port.
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	KeyFile  string `json:"key_file"`
+
+	TLS bool `json:"tls"`
+	// TLSCA verifies the server instead of the system roots, TLSCert and
+	// TLSKey are a client certificate for servers that require one. Any of
+	// them turns TLS on.
+	TLSCA   string `json:"tls_ca"`
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	KnownHosts string `json:"known_hosts"`
+}
+
+// Profile returns the profile called name, or the default one if name is
+// empty. With neither, it returns an empty profile.
+func (c *ClientConfig) Profile(name string) (Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == "" {
+		return Profile{}, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok && len(c.Profiles) == 0 {
+		return Profile{}, fmt.Errorf("no profile called %q, there are no profiles", name)
+	}
+	if !ok {
+		var names []string
+		for known := range c.Profiles {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("no profile called %q, the profiles are: %s", name, strings.Join(names, ", "))
+	}
+	return profile, nil
 }
@@ -0,0 +1,282 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeysFile is the name of the OpenSSH style key list that
+// readKeyDir reads alongside the <username>.pub files.
+const authorizedKeysFile = "authorized_keys"
+
+// revokedKeysFile lists keys that must no longer be accepted, one per line,
+// either by fingerprint (SHA256:...), by username/label, or by username to
+// revoke all of a user's keys.
+const revokedKeysFile = "revoked_keys"
+
+// DefaultLabel is the label of a key that wasn't given one, such as a plain
+// <username>.pub file.
+const DefaultLabel = "default"
+
+// userOption is the authorized_keys option that names the chat user a key
+// belongs to, e.g. shitchat-user="alice". Without it the user is taken from
+// the comment, minus any @host part. labelOption does the same for the key's
+// label, which otherwise comes from the @host part of the comment.
+const (
+	userOption  = "shitchat-user"
+	labelOption = "shitchat-label"
+)
+
+// Options and PEM headers that limit when a key may be used. expiry-time is
+// the option sshd itself understands.
+const (
+	notBeforeOption = "shitchat-not-before"
+	notAfterOption  = "expiry-time"
+	notBeforeHeader = "Not-Before"
+	notAfterHeader  = "Not-After"
+)
+
+// keySet is everything read from a key directory.
+type keySet struct {
+	users   map[string][]*Key
+	revoked map[string]bool
+}
+
+func (s *keySet) isRevoked(key *Key) bool {
+	return s.revoked[key.Fingerprint] || s.revoked[key.Username] || s.revoked[key.Username+"/"+key.Label]
+}
+
+// find returns username's key with the given fingerprint, or nil.
+func (s *keySet) find(username, fingerprint string) *Key {
+	for _, key := range s.users[username] {
+		if key.Fingerprint == fingerprint {
+			return key
+		}
+	}
+	return nil
+}
+
+func (s *keySet) add(key *Key) error {
+	for _, other := range s.users[key.Username] {
+		if other.Label == key.Label {
+			return fmt.Errorf("more than one key labelled %q for user %q", key.Label, key.Username)
+		}
+	}
+	s.users[key.Username] = append(s.users[key.Username], key)
+	return nil
+}
+
+// readKeyDir loads the keys in dir. A user's keys can be given as
+// <username>.pub, as <username>/<label>.pub for several labelled keys, or as
+// lines in authorized_keys.
+func readKeyDir(dir string) (*keySet, error) {
+	keys := &keySet{users: make(map[string][]*Key), revoked: make(map[string]bool)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		switch {
+		case file.Name() == authorizedKeysFile:
+			content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			authorized, err := parseAuthorizedKeys(content)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name(), err)
+			}
+			for _, key := range authorized {
+				if err := keys.add(key); err != nil {
+					return nil, fmt.Errorf("%s: %w", file.Name(), err)
+				}
+			}
+
+		case file.Name() == revokedKeysFile:
+			content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(string(content), "\n") {
+				line = strings.TrimSpace(line)
+				if line != "" && !strings.HasPrefix(line, "#") {
+					keys.revoked[line] = true
+				}
+			}
+
+		case file.IsDir():
+			username := file.Name()
+			userFiles, err := ioutil.ReadDir(filepath.Join(dir, username))
+			if err != nil {
+				return nil, err
+			}
+			for _, userFile := range userFiles {
+				if filepath.Ext(userFile.Name()) != ".pub" {
+					continue
+				}
+				name := filepath.Join(username, userFile.Name())
+				if err := readPublicKeyFile(keys, dir, name, username, strings.TrimSuffix(userFile.Name(), ".pub")); err != nil {
+					return nil, err
+				}
+			}
+
+		case filepath.Ext(file.Name()) == ".pub":
+			if err := readPublicKeyFile(keys, dir, file.Name(), strings.TrimSuffix(file.Name(), ".pub"), DefaultLabel); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return keys, nil
+}
+
+func readPublicKeyFile(keys *keySet, dir, name, username, label string) error {
+	content, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	key, err := parsePublicKey(username, label, content)
+	if err != nil {
+		return fmt.Errorf("could not decode %s: %w", name, err)
+	}
+
+	if err := keys.add(key); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// parsePublicKey reads a single public key, either a PEM "PUBLIC KEY" block or
+// one line in OpenSSH format as found in id_ed25519.pub. PEM blocks may carry
+// Not-Before and Not-After headers.
+func parsePublicKey(username, label string, content []byte) (*Key, error) {
+	if block, _ := pem.Decode(content); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newKey(username, label, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if key.NotBefore, err = parseKeyTime(block.Headers[notBeforeHeader]); err != nil {
+			return nil, fmt.Errorf("%s: %w", notBeforeHeader, err)
+		}
+		if key.NotAfter, err = parseKeyTime(block.Headers[notAfterHeader]); err != nil {
+			return nil, fmt.Errorf("%s: %w", notAfterHeader, err)
+		}
+		return key, nil
+	}
+
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := cryptoPublicKey(sshKey)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(username, label, publicKey)
+}
+
+// parseAuthorizedKeys reads an authorized_keys file and returns the key on
+// each line.
+func parseAuthorizedKeys(content []byte) ([]*Key, error) {
+	var keys []*Key
+	for i, text := range strings.Split(string(content), "\n") {
+		line := i + 1
+		text = strings.TrimSpace(text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		sshKey, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(text))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		commentUser, commentHost, _ := strings.Cut(comment, "@")
+		username := authorizedKeyOption(options, userOption)
+		if username == "" {
+			username = commentUser
+		}
+		if username == "" {
+			return nil, fmt.Errorf("line %d: no %s option or comment to take the username from", line, userOption)
+		}
+		label := authorizedKeyOption(options, labelOption)
+		if label == "" {
+			label = commentHost
+		}
+		if label == "" {
+			label = DefaultLabel
+		}
+
+		publicKey, err := cryptoPublicKey(sshKey)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		key, err := newKey(username, label, publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if key.NotBefore, err = parseKeyTime(authorizedKeyOption(options, notBeforeOption)); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, notBeforeOption, err)
+		}
+		if key.NotAfter, err = parseKeyTime(authorizedKeyOption(options, notAfterOption)); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", line, notAfterOption, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// authorizedKeyOption returns the value of the named authorized_keys option,
+// or "" if it isn't set.
+func authorizedKeyOption(options []string, name string) string {
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if ok && key == name {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// keyTimeFormats are the formats accepted for key validity dates: RFC 3339,
+// a plain date, and the YYYYMMDD[HHMM[SS]] form sshd uses for expiry-time.
+// Anything without a zone is taken as UTC.
+var keyTimeFormats = []string{time.RFC3339, "2006-01-02", "20060102150405", "200601021504", "20060102"}
+
+func parseKeyTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, format := range keyTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("could not parse time %q", value)
+}
+
+func cryptoPublicKey(sshKey ssh.PublicKey) (crypto.PublicKey, error) {
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %s", sshKey.Type())
+	}
+	return cryptoKey.CryptoPublicKey(), nil
+}
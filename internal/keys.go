@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrInvalidSignature is returned by Verify when a signature does not match.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Key is a public key registered for a chat user.
+type Key struct {
+	Username string
+	// Label tells a user's keys apart, usually by the device they live on.
+	Label     string
+	PublicKey crypto.PublicKey
+	// Fingerprint is the SHA256 fingerprint ssh-keygen -l would print.
+	Fingerprint string
+	// NotBefore and NotAfter limit when the key may be used. A zero time
+	// leaves that end open.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func newKey(username, label string, publicKey crypto.PublicKey) (*Key, error) {
+	if err := CheckPublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	fingerprint, err := Fingerprint(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Username: username, Label: label, PublicKey: publicKey, Fingerprint: fingerprint}, nil
+}
+
+// validAt returns an error if the key may not be used at t.
+func (k *Key) validAt(t time.Time) error {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return ErrKeyNotYetValid
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of pub in the same form as
+// ssh-keygen -l, which is how keys are named in the revocation list.
+func Fingerprint(pub crypto.PublicKey) (string, error) {
+	sshKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(sshKey), nil
+}
+
+// Sign signs data with key. RSA keys sign a SHA-256 hash with PKCS#1 v1.5,
+// ECDSA keys sign a SHA-256 hash with an ASN.1 signature and Ed25519 keys sign
+// data directly, which is what Verify expects for each key type.
+func Sign(key crypto.Signer, data []byte) ([]byte, error) {
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		hashed := sha256.Sum256(data)
+		return key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.Public())
+	}
+}
+
+// Verify checks a signature made by Sign.
+func Verify(pub crypto.PublicKey, data, signature []byte) error {
+	var ok bool
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, signature)
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature) == nil
+	case *ecdsa.PublicKey:
+		hashed := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(pub, hashed[:], signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// CheckPublicKey returns an error unless pub is a key type Verify supports.
+func CheckPublicKey(pub crypto.PublicKey) error {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// HostKeyChangedError is returned by KnownHosts.Check when a server presents
+// a different key from the one recorded for it.
+type HostKeyChangedError struct {
+	Host string
+	// Known is the fingerprint on record, Presented the one the server sent.
+	Known     string
+	Presented string
+	File      string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("the key for %s has changed from %s to %s", e.Host, e.Known, e.Presented)
+}
+
+// KnownHosts pins the key of every server the CLI connects to, trusting it
+// the first time like ssh does. The file has one "host fingerprint" pair per
+// line.
+type KnownHosts struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+// CertificateFingerprint returns the SHA256 fingerprint of a certificate's
+// public key, so a renewed certificate for the same key still matches.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Check compares fingerprint with the one recorded for host. An unknown host
+// is recorded and reported as added; a different fingerprint is a
+// *HostKeyChangedError.
+func (k *KnownHosts) Check(host, fingerprint string) (added bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	content, err := ioutil.ReadFile(k.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != host {
+			continue
+		}
+		if fields[1] != fingerprint {
+			return false, &HostKeyChangedError{Host: host, Known: fields[1], Presented: fingerprint, File: k.path}
+		}
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, fingerprint); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,9 @@
+package internal
+
+// ProtocolVersion is the version of the ClientEvent and ServerEvent protocol
+// spoken on MessageService.Connect.
+const ProtocolVersion = 1
+
+// DefaultChannel is the channel every stream starts out in, and where
+// messages that don't name a channel go.
+const DefaultChannel = "general"
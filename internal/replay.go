@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers which message ids each user has sent recently so a
+// captured message can't be sent again. Ids are only kept for maxAge, as
+// messages timestamped further than that from the server clock are rejected
+// anyway. If size ids are still remembered, the oldest is forgotten and
+// anything its user timestamped at or before it is rejected from then on, so
+// an evicted id can't be replayed either. That horizon is kept per user, so
+// one user's clock running ahead never gets anyone else's messages rejected.
+type ReplayCache struct {
+	mu       sync.Mutex
+	size     int
+	maxAge   time.Duration
+	seen     map[string]*list.Element
+	order    *list.List
+	horizons map[string]time.Time
+}
+
+type replayEntry struct {
+	username  string
+	key       string
+	timestamp time.Time
+}
+
+func NewReplayCache(size int, maxAge time.Duration) *ReplayCache {
+	return &ReplayCache{
+		size:     size,
+		maxAge:   maxAge,
+		seen:     make(map[string]*list.Element),
+		order:    list.New(),
+		horizons: make(map[string]time.Time),
+	}
+}
+
+// Check records that username sent id at timestamp and reports whether it is
+// the first time the cache has seen it.
+func (c *ReplayCache) Check(username, id string, timestamp time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+	if horizon, ok := c.horizons[username]; ok {
+		// Anything that old is stale, so the horizon has nothing left to do
+		if now.Sub(horizon) > c.maxAge {
+			delete(c.horizons, username)
+		} else if !timestamp.After(horizon) {
+			return false
+		}
+	}
+	key := username + "\x00" + id
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+
+	c.seen[key] = c.order.PushBack(replayEntry{username: username, key: key, timestamp: timestamp})
+	for c.order.Len() > c.size {
+		oldest := c.order.Remove(c.order.Front()).(replayEntry)
+		delete(c.seen, oldest.key)
+		if oldest.timestamp.After(c.horizons[oldest.username]) {
+			c.horizons[oldest.username] = oldest.timestamp
+		}
+	}
+	return true
+}
+
+// expire forgets ids old enough that their messages would be rejected for
+// being stale. Ids are mostly added in timestamp order, so it stops at the
+// first one that is still fresh.
+func (c *ReplayCache) expire(now time.Time) {
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(replayEntry)
+		if now.Sub(entry.timestamp) <= c.maxAge {
+			return
+		}
+		c.order.Remove(front)
+		delete(c.seen, entry.key)
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayCacheRejectsRepeats(t *testing.T) {
+	c := NewReplayCache(10, time.Minute)
+	now := time.Now()
+	if !c.Check("alice", "1", now) {
+		t.Fatal("first sighting of an id was rejected")
+	}
+	if c.Check("alice", "1", now) {
+		t.Error("repeated id was accepted")
+	}
+	if !c.Check("bob", "1", now) {
+		t.Error("another user's id with the same value was rejected")
+	}
+}
+
+func TestReplayCacheExpiresOldIds(t *testing.T) {
+	c := NewReplayCache(10, time.Minute)
+	now := time.Now()
+	stale := now.Add(-time.Minute - time.Second)
+	if !c.Check("alice", "old", stale) {
+		t.Fatal("first sighting of an id was rejected")
+	}
+	if !c.Check("alice", "new", now) {
+		t.Fatal("first sighting of an id was rejected")
+	}
+	if _, ok := c.seen["alice\x00old"]; ok {
+		t.Error("id older than maxAge is still remembered")
+	}
+	if c.order.Len() != 1 {
+		t.Errorf("cache holds %d ids, want 1", c.order.Len())
+	}
+	if c.Check("alice", "new", now) {
+		t.Error("fresh id was forgotten along with the stale one")
+	}
+}
+
+func TestReplayCacheHorizonAfterEviction(t *testing.T) {
+	c := NewReplayCache(2, time.Minute)
+	start := time.Now()
+	for i, id := range []string{"1", "2", "3"} {
+		if !c.Check("alice", id, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("first sighting of id %s was rejected", id)
+		}
+	}
+	if _, ok := c.seen["alice\x001"]; ok {
+		t.Fatal("id 1 wasn't evicted")
+	}
+
+	tests := []struct {
+		name      string
+		id        string
+		timestamp time.Time
+		want      bool
+	}{
+		{"evicted id", "1", start, false},
+		{"new id at the horizon", "4", start, false},
+		{"new id before the horizon", "5", start.Add(-time.Second), false},
+		{"new id after the horizon", "6", start.Add(3 * time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.Check("alice", tt.id, tt.timestamp); got != tt.want {
+				t.Errorf("Check(%q, %v) = %v, want %v", tt.id, tt.timestamp.Sub(start), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayCacheHorizonIsPerUser(t *testing.T) {
+	c := NewReplayCache(1, time.Hour)
+	now := time.Now()
+	// bob's clock is ahead, so evicting his first id puts his horizon in
+	// the future
+	if !c.Check("bob", "b1", now.Add(30*time.Minute)) || !c.Check("bob", "b2", now.Add(31*time.Minute)) {
+		t.Fatal("first sighting of an id was rejected")
+	}
+	if c.Check("bob", "b3", now) {
+		t.Error("bob's id behind his own horizon was accepted")
+	}
+	if !c.Check("alice", "a1", now) {
+		t.Error("alice's id was rejected because of bob's horizon")
+	}
+	if !c.Check("alice", "a2", now.Add(time.Millisecond)) {
+		t.Error("alice's id was rejected because of bob's horizon")
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SearchQuery selects messages by the words in them and where they came
+// from. Every field that is set has to match.
+type SearchQuery struct {
+	// Words are matched against the words of a message's body, ignoring
+	// case. A message has to contain all of them.
+	Words []string
+	// Sender and Channel limit the search to one user's messages or one
+	// channel. Direct messages are never in a channel.
+	Sender  string
+	Channel string
+	// User is who is searching. Direct messages are only found if they were
+	// sent or received by User, and channel messages if they are in one of
+	// Channels.
+	User     string
+	Channels map[string]bool
+	// Since and Until limit the search to [Since, Until), in unix
+	// milliseconds. Zero leaves that end open.
+	Since int64
+	Until int64
+
+	Limit int
+}
+
+// Tokenize splits text into the lower case words the search index uses.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchIndex maps every word to the messages that contain it. Messages are
+// numbered in the order they were added, so each posting list is in time
+// order.
+type searchIndex struct {
+	msgs  []*Message
+	words map[string][]int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{words: make(map[string][]int)}
+}
+
+func (x *searchIndex) add(m *Message) {
+	n := len(x.msgs)
+	x.msgs = append(x.msgs, m)
+
+	seen := make(map[string]bool)
+	for _, word := range Tokenize(m.Body) {
+		if !seen[word] {
+			seen[word] = true
+			x.words[word] = append(x.words[word], n)
+		}
+	}
+}
+
+// search returns up to q.Limit messages matching q, newest first.
+func (x *searchIndex) search(q SearchQuery) []*Message {
+	var words []string
+	for _, word := range q.Words {
+		words = append(words, Tokenize(word)...)
+	}
+
+	// Walk the shortest posting list and check the rest of the query
+	// against each message on it. Without any words every message is a
+	// candidate.
+	var candidates []int
+	if len(words) > 0 {
+		candidates = x.words[words[0]]
+		for _, word := range words[1:] {
+			if postings := x.words[word]; len(postings) < len(candidates) {
+				candidates = postings
+			}
+		}
+	}
+	n := len(x.msgs)
+	if len(words) > 0 {
+		n = len(candidates)
+	}
+
+	var found []*Message
+	for i := n - 1; i >= 0 && len(found) < q.Limit; i-- {
+		m := x.msgs[i]
+		if len(words) > 0 {
+			m = x.msgs[candidates[i]]
+		}
+		if q.Since != 0 && m.Timestamp < q.Since {
+			break
+		}
+		if q.matches(m, words) {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+func (q SearchQuery) matches(m *Message, words []string) bool {
+	switch {
+	case q.Until != 0 && m.Timestamp >= q.Until:
+		return false
+	case q.Sender != "" && m.Sender != q.Sender:
+		return false
+	case q.Channel != "" && (m.Recipient != "" || m.Channel != q.Channel):
+		return false
+	case m.Recipient != "" && m.Sender != q.User && m.Recipient != q.User:
+		return false
+	case m.Recipient == "" && !q.Channels[m.Channel]:
+		return false
+	}
+
+	if len(words) > 1 {
+		has := make(map[string]bool)
+		for _, word := range Tokenize(m.Body) {
+			has[word] = true
+		}
+		for _, word := range words {
+			if !has[word] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,426 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnknownMessage is returned when a query pages from a message id
+	// that isn't in the conversation.
+	ErrUnknownMessage = errors.New("no such message")
+	// ErrInvalidCursor is returned for a cursor that didn't come from an
+	// earlier page of the same conversation.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Message is a chat message as the server accepted it.
+type Message struct {
+	ID     string `json:"id"`
+	Sender string `json:"sender"`
+	Device string `json:"device,omitempty"`
+	// Timestamp is when the server accepted the message, in unix
+	// milliseconds.
+	Timestamp int64 `json:"timestamp"`
+	// Only one of Channel and Recipient is set.
+	Channel   string `json:"channel,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Body      string `json:"body"`
+	// Seq numbers the messages of a channel from 1, and is assigned by the
+	// store. Direct messages don't have one.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// MessageStore keeps every message the server has accepted.
+type MessageStore interface {
+	Append(msg *Message) error
+	// Last returns up to n of the most recent messages in channel, oldest
+	// first.
+	Last(channel string, n int) ([]*Message, error)
+	// After returns up to n of the most recent messages in channel with a
+	// sequence number above seq, oldest first.
+	After(channel string, seq uint64, n int) ([]*Message, error)
+	// LastDirect returns up to n of the most recent direct messages sent or
+	// received by username, oldest first.
+	LastDirect(username string, n int) ([]*Message, error)
+	// History returns a page of the messages q selects.
+	History(q HistoryQuery) (*HistoryPage, error)
+	// Sent returns the message username sent with id, or nil if there
+	// isn't one.
+	Sent(username, id string) (*Message, error)
+	// Search returns the messages q finds, newest first.
+	Search(q SearchQuery) ([]*Message, error)
+	// Epoch identifies the store's sequence numbers. It is different every
+	// time numbering starts over, so a sequence number only means something
+	// alongside the epoch it was given in.
+	Epoch() string
+	Close() error
+}
+
+// HistoryQuery selects messages from a channel, or the direct messages
+// between two users. Pages run backwards from the newest message unless
+// AfterID is set.
+type HistoryQuery struct {
+	Channel string
+	// User and Peer select the direct messages between them instead of a
+	// channel.
+	User, Peer string
+
+	// BeforeID and AfterID start the page next to a message. Cursor, which
+	// takes precedence, continues from the end of an earlier page.
+	BeforeID string
+	AfterID  string
+	Cursor   string
+
+	// Since and Until limit the page to messages timestamped in
+	// [Since, Until), in unix milliseconds. Zero leaves that end open.
+	Since int64
+	Until int64
+
+	Limit int
+}
+
+// HistoryPage is one page of a HistoryQuery.
+type HistoryPage struct {
+	// Messages are oldest first, whichever way the query pages.
+	Messages []*Message
+	// Next is the cursor for the following page, or "" if there isn't one.
+	Next string
+}
+
+// MemoryStore is a MessageStore that forgets everything when the server
+// stops. It keeps a search index up to date as messages are added.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	channels map[string][]*Message
+	direct   map[string][]*Message
+	index    *searchIndex
+	epoch    string
+	// sent finds messages by sender and id.
+	sent map[string]*Message
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		channels: make(map[string][]*Message),
+		direct:   make(map[string][]*Message),
+		sent:     make(map[string]*Message),
+		index:    newSearchIndex(),
+		epoch:    newEpoch(),
+	}
+}
+
+// newEpoch returns an epoch for a store that starts out empty. It only has
+// to differ from the ones before it.
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Epoch is new every time a MemoryStore is made, as it starts out empty.
+func (s *MemoryStore) Epoch() string {
+	return s.epoch
+}
+
+func (s *MemoryStore) Append(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index.add(msg)
+	s.sent[sentKey(msg.Sender, msg.ID)] = msg
+	if msg.Recipient == "" {
+		msg.Seq = uint64(len(s.channels[msg.Channel]) + 1)
+		s.channels[msg.Channel] = append(s.channels[msg.Channel], msg)
+		return nil
+	}
+	s.direct[msg.Recipient] = append(s.direct[msg.Recipient], msg)
+	if msg.Sender != msg.Recipient {
+		s.direct[msg.Sender] = append(s.direct[msg.Sender], msg)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Last(channel string, n int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return last(s.channels[channel], n), nil
+}
+
+func (s *MemoryStore) After(channel string, seq uint64, n int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Channel messages are stored in order from sequence number 1
+	msgs := s.channels[channel]
+	if seq >= uint64(len(msgs)) {
+		return nil, nil
+	}
+	return last(msgs[seq:], n), nil
+}
+
+// nextSeq returns the sequence number the next message in channel will get.
+func (s *MemoryStore) nextSeq(channel string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return uint64(len(s.channels[channel]) + 1)
+}
+
+func (s *MemoryStore) LastDirect(username string, n int) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return last(s.direct[username], n), nil
+}
+
+func (s *MemoryStore) History(q HistoryQuery) (*HistoryPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msgs := s.channels[q.Channel]
+	if q.User != "" {
+		msgs = s.direct[q.User]
+	}
+	matches := func(m *Message) bool {
+		if q.User != "" && m.Sender != q.Peer && m.Recipient != q.Peer {
+			return false
+		}
+		return (q.Since == 0 || m.Timestamp >= q.Since) && (q.Until == 0 || m.Timestamp < q.Until)
+	}
+
+	// Work out where the page starts and which way it runs
+	start, step := len(msgs)-1, -1
+	switch {
+	case q.Cursor != "":
+		direction, position, ok := strings.Cut(q.Cursor, ":")
+		i, err := strconv.Atoi(position)
+		if !ok || err != nil || i < 0 || i >= len(msgs) {
+			return nil, ErrInvalidCursor
+		}
+		switch direction {
+		case "before":
+			start = i - 1
+		case "after":
+			start, step = i+1, 1
+		default:
+			return nil, ErrInvalidCursor
+		}
+	case q.AfterID != "":
+		i := findMessage(msgs, q.AfterID)
+		if i < 0 {
+			return nil, ErrUnknownMessage
+		}
+		start, step = i+1, 1
+	case q.BeforeID != "":
+		i := findMessage(msgs, q.BeforeID)
+		if i < 0 {
+			return nil, ErrUnknownMessage
+		}
+		start = i - 1
+	}
+
+	// Take one more than asked for to find out if there is another page
+	page := &HistoryPage{}
+	last := -1
+	for i := start; i >= 0 && i < len(msgs) && len(page.Messages) <= q.Limit; i += step {
+		m := msgs[i]
+		// Messages are in time order, so past the far end of the range
+		// nothing else can match.
+		if step < 0 && q.Since != 0 && m.Timestamp < q.Since || step > 0 && q.Until != 0 && m.Timestamp >= q.Until {
+			break
+		}
+		if !matches(m) {
+			continue
+		}
+		if len(page.Messages) == q.Limit {
+			if step < 0 {
+				page.Next = fmt.Sprintf("before:%d", last)
+			} else {
+				page.Next = fmt.Sprintf("after:%d", last)
+			}
+			break
+		}
+		page.Messages = append(page.Messages, m)
+		last = i
+	}
+
+	if step < 0 {
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	return page, nil
+}
+
+// findMessage returns the index of the newest message in msgs with the given
+// id, or -1.
+func findMessage(msgs []*Message, id string) int {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *MemoryStore) Sent(username, id string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sent[sentKey(username, id)], nil
+}
+
+func sentKey(username, id string) string {
+	return username + "\x00" + id
+}
+
+func (s *MemoryStore) Search(q SearchQuery) ([]*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index.search(q), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// last copies up to the last n of msgs, so the caller can hold on to it
+// while more messages are appended.
+func last(msgs []*Message, n int) []*Message {
+	if n < len(msgs) {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return append([]*Message(nil), msgs...)
+}
+
+// FileStore is a MessageStore that appends every message to a file, one JSON
+// object per line, and reads them all back in when it is opened. Messages are
+// served from memory.
+//
+// A new file starts with a fileHeader line holding its epoch, which lasts as
+// long as the file does.
+type FileStore struct {
+	*MemoryStore
+
+	mu    sync.Mutex
+	file  *os.File
+	epoch string
+}
+
+type fileHeader struct {
+	Epoch string `json:"epoch"`
+}
+
+// OpenFileStore opens the store at path, creating it if needed. A last line
+// that was cut short, as happens when the server dies mid-write, is dropped.
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{MemoryStore: NewMemoryStore(), file: file}
+	end, err := store.load()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := file.Truncate(end); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if store.epoch == "" {
+		store.epoch = newEpoch()
+		line, _ := json.Marshal(fileHeader{Epoch: store.epoch})
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// load reads every complete line of the file into memory and returns the
+// offset just past the last one.
+func (s *FileStore) load() (int64, error) {
+	var end int64
+	reader := bufio.NewReader(s.file)
+	for line := 1; ; line++ {
+		text, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left over never got its newline
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		end += int64(len(text))
+
+		if len(bytes.TrimSpace(text)) == 0 {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(text, &msg); err != nil {
+			return 0, fmt.Errorf("line %d: %w", line, err)
+		}
+		if msg.ID == "" {
+			var header fileHeader
+			if err := json.Unmarshal(text, &header); err != nil || header.Epoch == "" {
+				return 0, fmt.Errorf("line %d: not a message", line)
+			}
+			s.epoch = header.Epoch
+			continue
+		}
+		// Files written before there were epochs don't have a header, but
+		// their first message is just as good at telling them apart.
+		if s.epoch == "" {
+			s.epoch = msg.ID
+		}
+		s.MemoryStore.Append(&msg)
+	}
+}
+
+// Epoch is kept in the file, so it stays the same across restarts.
+func (s *FileStore) Epoch() string {
+	return s.epoch
+}
+
+func (s *FileStore) Append(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Appends are serialised by s.mu, so the sequence number written is the
+	// one the MemoryStore gives the message below.
+	if msg.Recipient == "" {
+		msg.Seq = s.MemoryStore.nextSeq(msg.Channel)
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.MemoryStore.Append(msg)
+}
+
+// Close makes sure everything written has reached the disk and closes the
+// file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
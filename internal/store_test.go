@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// historyStore returns a store with messages m1 to m5 in #general, one
+// second apart, and direct messages d1 to d3 involving alice.
+func historyStore(t *testing.T) *MemoryStore {
+	t.Helper()
+	s := NewMemoryStore()
+	for i := 1; i <= 5; i++ {
+		msg := &Message{ID: fmt.Sprintf("m%d", i), Sender: "alice", Timestamp: int64(i) * 1000, Channel: DefaultChannel, Body: "hello"}
+		if err := s.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, pair := range [][2]string{{"alice", "bob"}, {"carol", "alice"}, {"bob", "alice"}} {
+		msg := &Message{ID: fmt.Sprintf("d%d", i+1), Sender: pair[0], Recipient: pair[1], Timestamp: int64(i+1) * 1000, Body: "psst"}
+		if err := s.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func messageIDs(msgs []*Message) []string {
+	ids := []string{}
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestMemoryStoreHistory(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    HistoryQuery
+		wantIDs  []string
+		wantNext string
+		wantErr  error
+	}{
+		{"newest page", HistoryQuery{Limit: 2}, []string{"m4", "m5"}, "before:3", nil},
+		{"everything fits", HistoryQuery{Limit: 10}, []string{"m1", "m2", "m3", "m4", "m5"}, "", nil},
+		{"backward from cursor", HistoryQuery{Cursor: "before:3", Limit: 2}, []string{"m2", "m3"}, "before:1", nil},
+		{"backward short last page", HistoryQuery{Cursor: "before:1", Limit: 2}, []string{"m1"}, "", nil},
+		{"backward exact last page", HistoryQuery{Cursor: "before:2", Limit: 2}, []string{"m1", "m2"}, "", nil},
+		{"before the oldest", HistoryQuery{Cursor: "before:0", Limit: 2}, []string{}, "", nil},
+		{"forward from id", HistoryQuery{AfterID: "m1", Limit: 2}, []string{"m2", "m3"}, "after:2", nil},
+		{"forward from cursor", HistoryQuery{Cursor: "after:1", Limit: 2}, []string{"m3", "m4"}, "after:3", nil},
+		{"forward exact last page", HistoryQuery{Cursor: "after:2", Limit: 2}, []string{"m4", "m5"}, "", nil},
+		{"after the newest", HistoryQuery{Cursor: "after:4", Limit: 2}, []string{}, "", nil},
+		{"backward from id", HistoryQuery{BeforeID: "m3", Limit: 5}, []string{"m1", "m2"}, "", nil},
+		{"cursor wins over id", HistoryQuery{BeforeID: "m5", Cursor: "before:2", Limit: 5}, []string{"m1", "m2"}, "", nil},
+		{"time range", HistoryQuery{Since: 2000, Until: 4000, Limit: 5}, []string{"m2", "m3"}, "", nil},
+		{"time range paged", HistoryQuery{Since: 2000, Limit: 2}, []string{"m4", "m5"}, "before:3", nil},
+		{"direct messages", HistoryQuery{User: "alice", Peer: "bob", Limit: 5}, []string{"d1", "d3"}, "", nil},
+		{"direct messages paged", HistoryQuery{User: "alice", Peer: "bob", Limit: 1}, []string{"d3"}, "before:2", nil},
+		{"unknown channel", HistoryQuery{Channel: "nowhere", Limit: 5}, []string{}, "", nil},
+		{"unknown before id", HistoryQuery{BeforeID: "nope", Limit: 2}, nil, "", ErrUnknownMessage},
+		{"unknown after id", HistoryQuery{AfterID: "nope", Limit: 2}, nil, "", ErrUnknownMessage},
+		{"cursor without position", HistoryQuery{Cursor: "before", Limit: 2}, nil, "", ErrInvalidCursor},
+		{"cursor with bad direction", HistoryQuery{Cursor: "sideways:1", Limit: 2}, nil, "", ErrInvalidCursor},
+		{"cursor with bad position", HistoryQuery{Cursor: "before:one", Limit: 2}, nil, "", ErrInvalidCursor},
+		{"cursor below range", HistoryQuery{Cursor: "after:-1", Limit: 2}, nil, "", ErrInvalidCursor},
+		{"cursor above range", HistoryQuery{Cursor: "before:5", Limit: 2}, nil, "", ErrInvalidCursor},
+		{"cursor from a longer channel", HistoryQuery{Channel: "nowhere", Cursor: "before:1", Limit: 2}, nil, "", ErrInvalidCursor},
+	}
+	s := historyStore(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			if q.Channel == "" && q.User == "" {
+				q.Channel = DefaultChannel
+			}
+			page, err := s.History(q)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := messageIDs(page.Messages); !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("got messages %v, want %v", got, tt.wantIDs)
+			}
+			if page.Next != tt.wantNext {
+				t.Errorf("got next cursor %q, want %q", page.Next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreHistoryPagesThroughEverything(t *testing.T) {
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  [][]string
+	}{
+		{"backward", HistoryQuery{Limit: 2}, [][]string{{"m4", "m5"}, {"m2", "m3"}, {"m1"}}},
+		{"forward", HistoryQuery{AfterID: "m1", Limit: 2}, [][]string{{"m2", "m3"}, {"m4", "m5"}}},
+	}
+	s := historyStore(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			q.Channel = DefaultChannel
+			var pages [][]string
+			for len(pages) <= len(tt.want) {
+				page, err := s.History(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, messageIDs(page.Messages))
+				if page.Next == "" {
+					break
+				}
+				q.Cursor = page.Next
+			}
+			if !reflect.DeepEqual(pages, tt.want) {
+				t.Errorf("got pages %v, want %v", pages, tt.want)
+			}
+		})
+	}
+}
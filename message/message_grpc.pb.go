@@ -19,14 +19,39 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	MessageService_Broadcast_FullMethodName = "/message.MessageService/Broadcast"
+	MessageService_Broadcast_FullMethodName    = "/message.MessageService/Broadcast"
+	MessageService_Connect_FullMethodName      = "/message.MessageService/Connect"
+	MessageService_ListChannels_FullMethodName = "/message.MessageService/ListChannels"
+	MessageService_History_FullMethodName      = "/message.MessageService/History"
+	MessageService_Search_FullMethodName       = "/message.MessageService/Search"
+	MessageService_Who_FullMethodName          = "/message.MessageService/Who"
 )
 
 // MessageServiceClient is the client API for MessageService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MessageServiceClient interface {
+	// Broadcast starts with a login handshake: the server sends a challenge,
+	// the client answers with a LoginRequest, and every request after that is
+	// a chat message from the logged in user.
+	//
+	// Broadcast can only carry chat messages and is kept for older clients;
+	// new clients should use Connect.
 	Broadcast(ctx context.Context, opts ...grpc.CallOption) (MessageService_BroadcastClient, error)
+	// Connect carries ClientEvents and ServerEvents. It starts with the same
+	// login handshake as Broadcast: the server sends a challenge event and the
+	// client's first event must be a login.
+	Connect(ctx context.Context, opts ...grpc.CallOption) (MessageService_ConnectClient, error)
+	// ListChannels returns every channel that has members.
+	ListChannels(ctx context.Context, in *ListChannelsRequest, opts ...grpc.CallOption) (*ListChannelsResponse, error)
+	// History pages through the stored messages of a channel, or the direct
+	// messages between the caller and another user.
+	History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error)
+	// Search finds stored messages by keyword, sender, channel and time.
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error)
+	// Who returns the users who are online. Connect streams are sent a
+	// PresenceEvent whenever that changes.
+	Who(ctx context.Context, in *WhoRequest, opts ...grpc.CallOption) (*WhoResponse, error)
 }
 
 type messageServiceClient struct {
@@ -68,11 +93,98 @@ func (x *messageServiceBroadcastClient) Recv() (*SendMessageResponse, error) {
 	return m, nil
 }
 
+func (c *messageServiceClient) Connect(ctx context.Context, opts ...grpc.CallOption) (MessageService_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MessageService_ServiceDesc.Streams[1], MessageService_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &messageServiceConnectClient{stream}
+	return x, nil
+}
+
+type MessageService_ConnectClient interface {
+	Send(*ClientEvent) error
+	Recv() (*ServerEvent, error)
+	grpc.ClientStream
+}
+
+type messageServiceConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *messageServiceConnectClient) Send(m *ClientEvent) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *messageServiceConnectClient) Recv() (*ServerEvent, error) {
+	m := new(ServerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *messageServiceClient) ListChannels(ctx context.Context, in *ListChannelsRequest, opts ...grpc.CallOption) (*ListChannelsResponse, error) {
+	out := new(ListChannelsResponse)
+	err := c.cc.Invoke(ctx, MessageService_ListChannels_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServiceClient) History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error) {
+	out := new(HistoryResponse)
+	err := c.cc.Invoke(ctx, MessageService_History_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServiceClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResponse, error) {
+	out := new(SearchResponse)
+	err := c.cc.Invoke(ctx, MessageService_Search_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageServiceClient) Who(ctx context.Context, in *WhoRequest, opts ...grpc.CallOption) (*WhoResponse, error) {
+	out := new(WhoResponse)
+	err := c.cc.Invoke(ctx, MessageService_Who_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MessageServiceServer is the server API for MessageService service.
 // All implementations must embed UnimplementedMessageServiceServer
 // for forward compatibility
 type MessageServiceServer interface {
+	// Broadcast starts with a login handshake: the server sends a challenge,
+	// the client answers with a LoginRequest, and every request after that is
+	// a chat message from the logged in user.
+	//
+	// Broadcast can only carry chat messages and is kept for older clients;
+	// new clients should use Connect.
 	Broadcast(MessageService_BroadcastServer) error
+	// Connect carries ClientEvents and ServerEvents. It starts with the same
+	// login handshake as Broadcast: the server sends a challenge event and the
+	// client's first event must be a login.
+	Connect(MessageService_ConnectServer) error
+	// ListChannels returns every channel that has members.
+	ListChannels(context.Context, *ListChannelsRequest) (*ListChannelsResponse, error)
+	// History pages through the stored messages of a channel, or the direct
+	// messages between the caller and another user.
+	History(context.Context, *HistoryRequest) (*HistoryResponse, error)
+	// Search finds stored messages by keyword, sender, channel and time.
+	Search(context.Context, *SearchRequest) (*SearchResponse, error)
+	// Who returns the users who are online. Connect streams are sent a
+	// PresenceEvent whenever that changes.
+	Who(context.Context, *WhoRequest) (*WhoResponse, error)
 	mustEmbedUnimplementedMessageServiceServer()
 }
 
@@ -83,6 +195,21 @@ type UnimplementedMessageServiceServer struct {
 func (UnimplementedMessageServiceServer) Broadcast(MessageService_BroadcastServer) error {
 	return status.Errorf(codes.Unimplemented, "method Broadcast not implemented")
 }
+func (UnimplementedMessageServiceServer) Connect(MessageService_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedMessageServiceServer) ListChannels(context.Context, *ListChannelsRequest) (*ListChannelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListChannels not implemented")
+}
+func (UnimplementedMessageServiceServer) History(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method History not implemented")
+}
+func (UnimplementedMessageServiceServer) Search(context.Context, *SearchRequest) (*SearchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
+func (UnimplementedMessageServiceServer) Who(context.Context, *WhoRequest) (*WhoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Who not implemented")
+}
 func (UnimplementedMessageServiceServer) mustEmbedUnimplementedMessageServiceServer() {}
 
 // UnsafeMessageServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -122,13 +249,128 @@ func (x *messageServiceBroadcastServer) Recv() (*SendMessageRequest, error) {
 	return m, nil
 }
 
+func _MessageService_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MessageServiceServer).Connect(&messageServiceConnectServer{stream})
+}
+
+type MessageService_ConnectServer interface {
+	Send(*ServerEvent) error
+	Recv() (*ClientEvent, error)
+	grpc.ServerStream
+}
+
+type messageServiceConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *messageServiceConnectServer) Send(m *ServerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *messageServiceConnectServer) Recv() (*ClientEvent, error) {
+	m := new(ClientEvent)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _MessageService_ListChannels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListChannelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).ListChannels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageService_ListChannels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).ListChannels(ctx, req.(*ListChannelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageService_History_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).History(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageService_History_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).History(ctx, req.(*HistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageService_Search_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).Search(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageService_Search_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).Search(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageService_Who_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WhoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageServiceServer).Who(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MessageService_Who_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageServiceServer).Who(ctx, req.(*WhoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MessageService_ServiceDesc is the grpc.ServiceDesc for MessageService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var MessageService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "message.MessageService",
 	HandlerType: (*MessageServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListChannels",
+			Handler:    _MessageService_ListChannels_Handler,
+		},
+		{
+			MethodName: "History",
+			Handler:    _MessageService_History_Handler,
+		},
+		{
+			MethodName: "Search",
+			Handler:    _MessageService_Search_Handler,
+		},
+		{
+			MethodName: "Who",
+			Handler:    _MessageService_Who_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "Broadcast",
@@ -136,6 +378,12 @@ var MessageService_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Connect",
+			Handler:       _MessageService_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "message/message.proto",
 }